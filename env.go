@@ -0,0 +1,142 @@
+package mandira
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// An Env holds the filters and options which templates are parsed and
+// rendered with.  Templates remember the Env they were parsed in, and look
+// up filters in it when they are rendered.  The package level functions use
+// DefaultEnv.
+type Env struct {
+	Options
+	filters *filterSet
+}
+
+// DefaultEnv is the Env used by ParseString, ParseFile, AddFilter and the
+// other package level functions.
+var DefaultEnv = NewEnv()
+
+// NewEnv returns an Env with the default options and the builtin filters.
+func NewEnv() *Env {
+	env := &Env{filters: &filterSet{filters: map[string]interface{}{}}}
+	addBuiltinFilters(env)
+	return env
+}
+
+// a set of named filters which is safe for concurrent use
+type filterSet struct {
+	mu      sync.RWMutex
+	filters map[string]interface{}
+}
+
+// Return an error if filter can't be used as a filter.  Filters are functions
+// which take the filtered value and any arguments, and return a single value
+// or a value and an error.
+func checkFilter(filter interface{}) error {
+	typ := reflect.TypeOf(filter)
+	if typ == nil || typ.Kind() != reflect.Func {
+		return fmt.Errorf("filter must be a function, not %T", filter)
+	}
+	if typ.NumIn() == 0 {
+		return fmt.Errorf("filter %s must take at least one argument", typ)
+	}
+	if typ.NumIn() == 1 && typ.IsVariadic() {
+		return fmt.Errorf("filter %s must take the filtered value as its first argument", typ)
+	}
+	switch typ.NumOut() {
+	case 1:
+	case 2:
+		if typ.Out(1) != errorType {
+			return fmt.Errorf("filter %s must return a value or a value and an error", typ)
+		}
+	default:
+		return fmt.Errorf("filter %s must return a value or a value and an error", typ)
+	}
+	return nil
+}
+
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+// Add a filter to the environment.  If no name is given, the filter is
+// named after its function, in lower case.  An error is returned if filter
+// is not a function which can be used as a filter.
+func (e *Env) AddFilter(filter interface{}, name ...string) error {
+	if err := checkFilter(filter); err != nil {
+		return err
+	}
+	var fname string
+	if len(name) == 1 {
+		fname = name[0]
+	} else {
+		val := reflect.ValueOf(filter)
+		// this returns something like: /jmoiron/devel/mandira.Len
+		spl := strings.Split(runtime.FuncForPC(val.Pointer()).Name(), ".")
+		fname = strings.ToLower(spl[len(spl)-1])
+	}
+
+	e.filters.mu.Lock()
+	e.filters.filters[fname] = filter
+	e.filters.mu.Unlock()
+	return nil
+}
+
+// Check that the filters in expr which exist in the environment are given
+// the right number of arguments.  Filters which don't exist yet are left to
+// be checked when the template is rendered.
+func (e *Env) checkFilters(expr interface{}) error {
+	return walkFuncExprs(expr, func(f *funcExpr) error {
+		filter := e.GetFilter(f.name)
+		if filter == nil {
+			return nil
+		}
+		_, err := f.checkArity(reflect.TypeOf(filter))
+		return err
+	})
+}
+
+// Return a filter (or nil)
+func (e *Env) GetFilter(name string) interface{} {
+	e.filters.mu.RLock()
+	defer e.filters.mu.RUnlock()
+	filter, ok := e.filters.filters[name]
+	if !ok {
+		return nil
+	}
+	return filter
+}
+
+// Parse a template from a string.
+func (e *Env) ParseString(data string) (*Template, error) {
+	resolver := e.Resolver
+	if resolver == nil {
+		cwd := os.Getenv("CWD")
+		resolver = &fileResolver{dir: cwd, env: e}
+	}
+	return parseTemplate("", data, e, resolver)
+}
+
+// Parse a template from a file.
+func (e *Env) ParseFile(filename string) (*Template, error) {
+	abs, err := filepath.Abs(filename)
+	if err != nil {
+		return nil, err
+	}
+	return parseFile(filename, e, []string{abs})
+}
+
+// Return a new loader which parses templates in this environment.
+func (e *Env) NewLoader(path string, preload bool) *Loader {
+	return newLoader(path, preload, e)
+}
+
+// Return an environment with opts which shares its filters with e.
+func (e *Env) withOptions(opts Options) *Env {
+	return &Env{Options: opts, filters: e.filters}
+}
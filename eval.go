@@ -3,268 +3,720 @@
 package mandira
 
 import (
-	"errors"
 	"fmt"
+	"math"
+	"math/bits"
 	"reflect"
+	"strings"
+	"time"
 )
 
-func compInt(oper string, l, r int64) bool {
-	switch oper {
-	case ">":
-		return l > r
-	case ">=":
-		return l >= r
-	case "<":
-		return l < r
-	case "<=":
-		return l <= r
-	case "!=":
-		return l != r
-	case "==":
-		return l == r
+// A strictError is returned for a name or filter which can't be found, or a
+// filter which can't be called with its arguments.  Outside of strict mode,
+// these are not errors, and the expression evaluates to an empty string.
+type strictError string
+
+func (e strictError) Error() string { return string(e) }
+
+// Return the error for a name which isn't found.  Since names may contain
+// hyphens, a name like "page-1" which was meant as a subtraction is a name,
+// so if it isn't a difference either, the error suggests the spaces it is
+// missing.
+func undefinedName(name string) error {
+	msg := fmt.Sprintf("undefined name %q", name)
+	if i := strings.LastIndex(name, "-"); i > 0 && i < len(name)-1 {
+		msg += fmt.Sprintf(" (to subtract, use spaces: %s - %s)", name[:i], name[i+1:])
 	}
-	return false
+	return strictError(msg)
+}
+
+// A FilterError is returned when a filter returns a non-nil error.
+type FilterError struct {
+	Filter string
+	Err    error
+}
+
+func (e *FilterError) Error() string {
+	return fmt.Sprintf("filter %q: %s", e.Filter, e.Err)
 }
 
-func compString(oper, l, r string) bool {
+func (e *FilterError) Unwrap() error { return e.Err }
+
+// Return the result of oper given the order c of two values, which is
+// negative if the left is less than the right, 0 if they are equal and
+// positive if the left is greater.
+func compOrder(oper string, c int) bool {
 	switch oper {
 	case ">":
-		return l > r
+		return c > 0
 	case ">=":
-		return l >= r
+		return c >= 0
 	case "<":
-		return l < r
+		return c < 0
 	case "<=":
-		return l <= r
+		return c <= 0
 	case "!=":
-		return l != r
+		return c != 0
 	case "==":
-		return l == r
+		return c == 0
 	}
 	return false
-
 }
 
-// run eval for something which is a cond or a conditional
-func Eval(expr interface{}, contexts []interface{}) (interface{}, error) {
-	switch expr.(type) {
-	case *cond:
-		return expr.(*cond).Eval(contexts)
-	case *conditional:
-		return expr.(*conditional).Eval(contexts), nil
-	case bool:
-		return expr.(bool), nil
-	default:
-		fmt.Printf("Got unknown type for interface %v: %s", expr, reflect.ValueOf(expr).Kind())
+// Return the order of two numbers of any kind.  Integers are compared
+// exactly, and are promoted to float64 if either number is a float.
+func compareNumbers(l, r reflect.Value) int {
+	switch {
+	case isFloat(l.Kind()) || isFloat(r.Kind()):
+		return compareFloats(toFloat(l), toFloat(r))
+	case isUnsigned(l.Kind()) && isUnsigned(r.Kind()):
+		return compareUints(l.Uint(), r.Uint())
+	case isUnsigned(l.Kind()):
+		if r.Int() < 0 {
+			return 1
+		}
+		return compareUints(l.Uint(), uint64(r.Int()))
+	case isUnsigned(r.Kind()):
+		if l.Int() < 0 {
+			return -1
+		}
+		return compareUints(uint64(l.Int()), r.Uint())
 	}
-	return nil, nil
+	return compareInts(l.Int(), r.Int())
 }
 
-// Evaluate a unary condition;  evaluates either to the value of the expression
-// or a boolean (tested with isNil) if the expression is a negation
-func (c *cond) Eval(contexts []interface{}) (interface{}, error) {
-	var exprval interface{}
-	switch c.expr.(type) {
-	case *varExpr:
-		exprval, _ = c.expr.(*varExpr).Eval(contexts)
-	case string:
-		exprval = c.expr.(string)
-	case int64:
-		exprval = c.expr.(int64)
-	case float64:
-		exprval = c.expr.(float64)
+func compareInts(l, r int64) int {
+	switch {
+	case l < r:
+		return -1
+	case l > r:
+		return 1
 	}
+	return 0
+}
 
-	if c.not {
-		return isNil(reflect.ValueOf(exprval)), nil
+func compareUints(l, r uint64) int {
+	switch {
+	case l < r:
+		return -1
+	case l > r:
+		return 1
 	}
-	return exprval, nil
+	return 0
 }
 
-func (c *conditional) Eval(contexts []interface{}) bool {
-	// fast path for single expression conditional exprs like (foo)
-	if len(c.opers) == 0 {
-		val, err := Eval(c.exprs[0], contexts)
-		if err != nil {
-			return false
-		}
-		ret := !isNil(reflect.ValueOf(val))
-		if c.not {
-			return !ret
-		}
-		return ret
+func compareFloats(l, r float64) int {
+	switch {
+	case l < r:
+		return -1
+	case l > r:
+		return 1
 	}
+	return 0
+}
 
-	// apply numeric logic operators first
+func isUnsigned(k reflect.Kind) bool {
+	switch k {
+	case reflect.Uint, reflect.Uintptr, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return true
+	}
+	return false
+}
 
-	var lhs interface{}
-	var rhs interface{}
+// Return whether op is an equality operator, which can compare values that
+// have no order.
+func isEquality(op string) bool {
+	return op == "==" || op == "!="
+}
 
-	var opers []string
-	var exprs []interface{}
-	reduced := false
+var timeType = reflect.TypeOf(time.Time{})
 
-	for i, oper := range c.opers {
-		if reduced {
-			reduced = false
-			opers = append(opers, oper)
-			continue
-		}
-		lhs = c.exprs[i]
-		rhs = c.exprs[i+1]
-		switch oper {
-		case "or", "and":
-			opers = append(opers, oper)
-			exprs = append(exprs, lhs)
-		default:
-			value := CompEval(oper, lhs, rhs, contexts)
-			exprs = append(exprs, value)
-			reduced = true
-		}
-	}
-	if !reduced {
-		exprs = append(exprs, c.exprs[len(c.exprs)-1])
+// Evaluate a condition to a bool;  a condition is true if its value is not
+// nil in the sense of isNil
+func evalCondition(s *state, c condition, contexts []interface{}) (bool, error) {
+	val, err := c.Eval(s, contexts)
+	if err != nil {
+		return false, err
 	}
+	return !isNil(reflect.ValueOf(val)), nil
+}
 
-	if len(opers) == 0 {
-		ret := !isNil(reflect.ValueOf(exprs[0]))
-		if c.not {
-			return !ret
-		}
-		return ret
-
-	}
+// Evaluate a value condition to the value of its expression.
+func (c *valueExpr) Eval(s *state, contexts []interface{}) (interface{}, error) {
+	return evalOrNil(s, c.expr, contexts)
+}
 
-	lhs = exprs[0]
-	for i, oper := range opers {
-		rhs = exprs[i+1]
-		lhs = BoolEval(oper, lhs, rhs, contexts)
+// Evaluate a value like evalOperand, keeping nil values so that they can be
+// compared.  Outside of strict mode, names which aren't found and operands of
+// the wrong type are nil.
+func evalOrNil(s *state, expr interface{}, contexts []interface{}) (interface{}, error) {
+	val, err := evalOperand(s, expr, contexts)
+	if _, ok := err.(strictError); ok && !s.strict {
+		return nil, nil
 	}
+	return val, err
+}
 
-	if c.not {
-		return !lhs.(bool)
+// Evaluate a negation to a bool
+func (c *notExpr) Eval(s *state, contexts []interface{}) (interface{}, error) {
+	ok, err := evalCondition(s, c.expr, contexts)
+	if err != nil {
+		return nil, err
 	}
-	return lhs.(bool)
+	return !ok, nil
 }
 
-func BoolEval(oper string, lhs, rhs interface{}, contexts []interface{}) bool {
-	lhsv, err := Eval(lhs, contexts)
+// Evaluate a comparison to a bool.  Outside of strict mode, a nil value,
+// like a name which isn't found, is not ordered before or after anything.
+func (c *compExpr) Eval(s *state, contexts []interface{}) (interface{}, error) {
+	lhs, err := evalComparand(s, c.lhs, contexts)
 	if err != nil {
-		fmt.Printf("Error: %q\n", err)
-		lhsv = false
+		return nil, err
 	}
-	rhsv, err := Eval(rhs, contexts)
+	rhs, err := evalComparand(s, c.rhs, contexts)
 	if err != nil {
-		fmt.Printf("Error: %q\n", err)
-		rhsv = false
+		return nil, err
+	}
+	if !s.strict && !isEquality(c.op) && (isNilValue(lhs) || isNilValue(rhs)) {
+		return false, nil
 	}
+	return compare(c.op, lhs, rhs)
+}
 
-	switch oper {
-	case "and":
-		return !isNil(reflect.ValueOf(lhsv)) && !isNil(reflect.ValueOf(rhsv))
-	case "or":
-		return !isNil(reflect.ValueOf(lhsv)) || !isNil(reflect.ValueOf(rhsv))
+// The values of true, false and nil when they aren't names in the context
+var literalNames = map[string]interface{}{"true": true, "false": false, "nil": nil}
+
+// Evaluate an operand of a comparison.  A bare true, false or nil which isn't
+// a name in the context is a literal, so that bools and nil values can be
+// compared.
+func evalComparand(s *state, c condition, contexts []interface{}) (interface{}, error) {
+	if v, ok := c.(*valueExpr); ok {
+		if e, ok := v.expr.(*varExpr); ok && len(e.exprs) == 1 {
+			if l, ok := e.exprs[0].(*lookupExpr); ok {
+				if lit, ok := literalNames[l.name]; ok {
+					if val, err := lookup(contexts, l.name); err == nil && !val.IsValid() {
+						return lit, nil
+					}
+				}
+			}
+		}
 	}
-	return false
+	return c.Eval(s, contexts)
+}
+
+// Return whether v is nil, or a nil pointer or interface.
+func isNilValue(v interface{}) bool {
+	return !indirect(reflect.ValueOf(v)).IsValid()
 }
 
-func CompEval(oper string, lhs, rhs interface{}, contexts []interface{}) bool {
-	lhsv, err := Eval(lhs, contexts)
+// Evaluate "and" or "or" to a bool.  The right hand side is only evaluated
+// if the left hand side does not decide the result.
+func (c *boolExpr) Eval(s *state, contexts []interface{}) (interface{}, error) {
+	ok, err := evalCondition(s, c.lhs, contexts)
 	if err != nil {
-		fmt.Printf("Error: %q\n", err)
-		return false
+		return nil, err
 	}
-	rhsv, err := Eval(rhs, contexts)
-	if err != nil {
-		fmt.Printf("Error: %q\n", err)
-		return false
+	switch c.op {
+	case "and":
+		if !ok {
+			return false, nil
+		}
+	case "or":
+		if ok {
+			return true, nil
+		}
+	default:
+		return nil, fmt.Errorf("unknown operator %q", c.op)
 	}
+	return evalCondition(s, c.rhs, contexts)
+}
 
-	vl := reflect.ValueOf(lhsv)
-	vr := reflect.ValueOf(rhsv)
+// Compare two values with a binop.  Numbers of any kind are compared by
+// value, strings and times are ordered, and bools and other comparable values
+// of the same type can be tested for equality.  A nil value is only equal to
+// another nil value, and values of different types are never equal.  Other
+// operands can't be compared with oper, and return an error.
+func compare(oper string, lhs, rhs interface{}) (ret bool, err error) {
+	vl := indirect(reflect.ValueOf(lhs))
+	vr := indirect(reflect.ValueOf(rhs))
 
 	defer func() {
 		if r := recover(); r != nil {
-			fmt.Printf("Panic while doing comparisson: %v, %v", lhs, rhs)
+			ret, err = false, fmt.Errorf("cannot compare %#v %s %#v: %v", lhs, oper, rhs, r)
 		}
 	}()
 
-	switch vl.Kind() {
-	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-		return compInt(oper, vl.Int(), vr.Int())
-	case reflect.Uint, reflect.Uintptr, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
-		return compInt(oper, int64(vl.Uint()), int64(vr.Uint()))
-	case reflect.String:
-		return compString(oper, vl.String(), vr.String())
+	switch {
+	case !vl.IsValid() || !vr.IsValid():
+		if isEquality(oper) {
+			return (vl.IsValid() == vr.IsValid()) == (oper == "=="), nil
+		}
+	case isNumber(vl.Kind()) && isNumber(vr.Kind()):
+		if (isFloat(vl.Kind()) && math.IsNaN(vl.Float())) || (isFloat(vr.Kind()) && math.IsNaN(vr.Float())) {
+			return oper == "!=", nil
+		}
+		return compOrder(oper, compareNumbers(vl, vr)), nil
+	case vl.Kind() == reflect.String && vr.Kind() == reflect.String:
+		return compOrder(oper, strings.Compare(vl.String(), vr.String())), nil
+	case vl.Type() == timeType && vr.Type() == timeType:
+		l, r := vl.Interface().(time.Time), vr.Interface().(time.Time)
+		return compOrder(oper, l.Compare(r)), nil
+	case vl.Kind() == reflect.Bool && vr.Kind() == reflect.Bool:
+		if isEquality(oper) {
+			return (vl.Bool() == vr.Bool()) == (oper == "=="), nil
+		}
+	case vl.Type() != vr.Type():
+		// values of different types are never equal
+		if isEquality(oper) {
+			return oper == "!=", nil
+		}
+	case vl.Type().Comparable():
+		if isEquality(oper) {
+			return (vl.Interface() == vr.Interface()) == (oper == "=="), nil
+		}
+	}
+	return false, fmt.Errorf("cannot compare %s %s %s", describe(vl), oper, describe(vr))
+}
+
+// Describe a value and its type for an error message.
+func describe(v reflect.Value) string {
+	if !v.IsValid() {
+		return "nil"
 	}
+	return fmt.Sprintf("%#v (%s)", v.Interface(), v.Type())
+}
 
+// Convert v so that it can be passed to a filter as a parameter of type t.
+// Numbers are converted between kinds, strings between string types like
+// SafeString, and a missing value is passed as the zero value of types which
+// can be nil.
+func convertArg(v reflect.Value, t reflect.Type) (reflect.Value, bool) {
+	if !v.IsValid() {
+		switch t.Kind() {
+		case reflect.Interface, reflect.Ptr, reflect.Slice, reflect.Map:
+			return reflect.Zero(t), true
+		}
+		return v, false
+	}
+	if v.Type().AssignableTo(t) {
+		return v, true
+	}
+	if isNumber(v.Kind()) && isNumber(t.Kind()) {
+		return v.Convert(t), true
+	}
+	if v.Kind() == reflect.String && t.Kind() == reflect.String {
+		return v.Convert(t), true
+	}
+	return v, false
+}
+
+func isNumber(k reflect.Kind) bool {
+	switch k {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uintptr, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
+
+// Return whether a filter parameter of type t can take keyword arguments.
+// This is true for maps with string keys, structs and pointers to structs.
+func isOptions(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Map:
+		return t.Key().Kind() == reflect.String
+	case reflect.Struct:
+		return true
+	case reflect.Ptr:
+		return t.Elem().Kind() == reflect.Struct
+	}
 	return false
 }
 
+// Check that a filter of type t can be called with the arguments to f.  If
+// the filter's last parameter takes f's keyword arguments, keywords is true;
+// that parameter can be left out even if there aren't any.
+func (f *funcExpr) checkArity(t reflect.Type) (keywords bool, err error) {
+	n := t.NumIn() - 1
+	if t.IsVariadic() {
+		if len(f.keywords) > 0 {
+			return false, fmt.Errorf("filter %q does not take keyword arguments", f.name)
+		}
+		if len(f.arguments) < n-1 {
+			return false, fmt.Errorf("filter %q takes at least %d arguments, got %d", f.name, n-1, len(f.arguments))
+		}
+		return false, nil
+	}
+	if n > 0 && len(f.arguments) == n-1 && isOptions(t.In(n)) {
+		return true, nil
+	}
+	if len(f.keywords) > 0 {
+		return false, fmt.Errorf("filter %q does not take keyword arguments", f.name)
+	}
+	if len(f.arguments) != n {
+		return false, fmt.Errorf("filter %q takes %d arguments, got %d", f.name, n, len(f.arguments))
+	}
+	return false, nil
+}
+
+// Evaluate an argument to a filter, which is passed as a parameter of type t.
+func (f *funcExpr) evalArg(s *state, contexts []interface{}, arg interface{}, t reflect.Type) (reflect.Value, error) {
+	var val interface{}
+	switch arg := arg.(type) {
+	case string, int64, int, float64:
+		val = arg
+	case *varExpr, *arithExpr:
+		v, err := evalOperand(s, arg, contexts)
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		val = v
+	default:
+		return reflect.Value{}, fmt.Errorf("unknown argument type %T for filter %q", arg, f.name)
+	}
+	// values passed as strings are formatted like they are rendered
+	if _, ok := val.(string); !ok && val != nil && t.Kind() == reflect.String {
+		val = fmt.Sprint(val)
+	}
+	rv, ok := convertArg(reflect.ValueOf(val), t)
+	if !ok {
+		return rv, strictError(fmt.Sprintf("filter %q cannot use %#v as %s", f.name, val, t))
+	}
+	return rv, nil
+}
+
+// Build the options parameter of type t from the keyword arguments to f.
+// Keywords are map keys, or the names of struct fields, ignoring case.
+func (f *funcExpr) options(s *state, contexts []interface{}, t reflect.Type) (reflect.Value, error) {
+	if t.Kind() == reflect.Map {
+		opts := reflect.MakeMap(t)
+		for _, kw := range f.keywords {
+			val, err := f.evalArg(s, contexts, kw.value, t.Elem())
+			if err != nil {
+				return opts, err
+			}
+			opts.SetMapIndex(reflect.ValueOf(kw.name).Convert(t.Key()), val)
+		}
+		return opts, nil
+	}
+
+	st := t
+	if t.Kind() == reflect.Ptr {
+		st = t.Elem()
+	}
+	opts := reflect.New(st).Elem()
+	for _, kw := range f.keywords {
+		name := kw.name
+		field := opts.FieldByNameFunc(func(n string) bool { return strings.EqualFold(n, name) })
+		if !field.IsValid() || !field.CanSet() {
+			return opts, strictError(fmt.Sprintf("filter %q has no option %q", f.name, name))
+		}
+		val, err := f.evalArg(s, contexts, kw.value, field.Type())
+		if err != nil {
+			return opts, err
+		}
+		field.Set(val)
+	}
+	if t.Kind() == reflect.Ptr {
+		return opts.Addr(), nil
+	}
+	return opts, nil
+}
+
 // Apply a filter to a value
-func (f *funcExpr) Apply(contexts []interface{}, input interface{}) (interface{}, error) {
+func (f *funcExpr) Apply(s *state, contexts []interface{}, input interface{}) (ret interface{}, err error) {
 	defer func() {
 		if r := recover(); r != nil {
-			fmt.Printf("Panic while applying filter %q: %v, %v", f.name, input, f.arguments)
+			ret, err = nil, fmt.Errorf("panic applying filter %q to %#v: %v", f.name, input, r)
 		}
 	}()
 
-	filter := GetFilter(f.name)
+	filter := s.env.GetFilter(f.name)
 	if filter == nil {
-		return nil, fmt.Errorf("Could not find filter: %s", f.name)
+		return nil, strictError(fmt.Sprintf("undefined filter %q", f.name))
 	}
 
 	filterVal := reflect.ValueOf(filter)
 	filterType := filterVal.Type()
 
-	argvals := []reflect.Value{reflect.ValueOf(input)}
+	keywords, err := f.checkArity(filterType)
+	if err != nil {
+		return nil, strictError(err.Error())
+	}
+
+	in, ok := convertArg(reflect.ValueOf(input), filterType.In(0))
+	if !ok {
+		return nil, strictError(fmt.Sprintf("filter %q cannot use %#v as %s", f.name, input, filterType.In(0)))
+	}
+	argvals := []reflect.Value{in}
 	for i, arg := range f.arguments {
-		switch arg.(type) {
-		case string, int64, int, float64:
-			argvals = append(argvals, reflect.ValueOf(arg))
-		case *lookupExpr:
-			lu := arg.(*lookupExpr)
-			val := lookup(contexts, lu.name)
-			if !val.IsValid() {
-				return "", fmt.Errorf("Invalid lookup for filter argument: %s", lu.name)
-			}
-			argtype := filterType.In(i + 1)
-			switch argtype.Kind() {
-			case reflect.String:
-				argvals = append(argvals, reflect.ValueOf(fmt.Sprint(val.Interface())))
-			case reflect.Int, reflect.Int64:
-				argvals = append(argvals, reflect.ValueOf(val.Int()))
-			}
+		var t reflect.Type
+		// extra arguments to a variadic filter have the type of its last parameter
+		if last := filterType.NumIn() - 1; filterType.IsVariadic() && i+1 >= last {
+			t = filterType.In(last).Elem()
+		} else {
+			t = filterType.In(i + 1)
+		}
+		val, err := f.evalArg(s, contexts, arg, t)
+		if err != nil {
+			return nil, err
+		}
+		argvals = append(argvals, val)
+	}
+	if keywords {
+		opts, err := f.options(s, contexts, filterType.In(filterType.NumIn()-1))
+		if err != nil {
+			return nil, err
+		}
+		argvals = append(argvals, opts)
+	}
+
+	results := filterVal.Call(argvals)
+	if len(results) == 2 && !results[1].IsNil() {
+		return nil, &FilterError{f.name, results[1].Interface().(error)}
+	}
+	// a string made from an already escaped string is still escaped
+	ret = results[0].Interface()
+	if str, ok := ret.(string); ok {
+		if _, safe := input.(SafeString); safe {
+			return SafeString(str), nil
+		}
+	}
+	return ret, nil
+}
+
+// Evaluate an operand of a varExpr or arithExpr, which is a lookupExpr,
+// varExpr, arithExpr or literal.  A name which isn't found is a strictError.
+func evalOperand(s *state, expr interface{}, contexts []interface{}) (interface{}, error) {
+	switch e := expr.(type) {
+	case *lookupExpr:
+		val, err := s.lookup(contexts, e.name)
+		if err != nil {
+			return nil, err
+		}
+		if !val.IsValid() {
+			return nil, undefinedName(e.name)
+		}
+		return val.Interface(), nil
+	case *varExpr:
+		return e.eval(s, contexts)
+	case *arithExpr:
+		return e.eval(s, contexts)
+	}
+	return expr, nil
+}
+
+// Evaluate an arithExpr.  Outside of strict mode, names which aren't found
+// and operands of the wrong type evaluate to an empty string, but division
+// by zero is always an error.
+func (a *arithExpr) Eval(s *state, contexts []interface{}) (interface{}, error) {
+	val, err := a.eval(s, contexts)
+	if _, ok := err.(strictError); ok && !s.strict {
+		return "", nil
+	}
+	return val, err
+}
+
+func (a *arithExpr) eval(s *state, contexts []interface{}) (interface{}, error) {
+	lhs, err := evalOperand(s, a.lhs, contexts)
+	if err != nil {
+		return nil, err
+	}
+	rhs, err := evalOperand(s, a.rhs, contexts)
+	if err != nil {
+		return nil, err
+	}
+	return arith(a.op, lhs, rhs)
+}
+
+// Compute l op r.  ~ concatenates the values as strings, and + also adds
+// strings.  Otherwise, both values must be numbers;  integers of any kind are
+// computed exactly, and division truncates.  The result is an int64, or a
+// uint64 if it is too large for one, and a result too large for either is an
+// error.  If either value is a float, both are computed as float64.
+func arith(op string, l, r interface{}) (interface{}, error) {
+	if op == "~" {
+		return concat(emptyIfNil(l), emptyIfNil(r)), nil
+	}
+	lv, rv := indirect(reflect.ValueOf(l)), indirect(reflect.ValueOf(r))
+	if op == "+" && lv.Kind() == reflect.String && rv.Kind() == reflect.String {
+		return concat(lv.Interface(), rv.Interface()), nil
+	}
+	if !isNumber(lv.Kind()) || !isNumber(rv.Kind()) {
+		return nil, strictError(fmt.Sprintf("cannot compute %#v %s %#v", l, op, r))
+	}
+
+	if isFloat(lv.Kind()) || isFloat(rv.Kind()) {
+		x, y := toFloat(lv), toFloat(rv)
+		switch op {
+		case "+":
+			return x + y, nil
+		case "-":
+			return x - y, nil
+		case "*":
+			return x * y, nil
+		}
+		if y == 0 {
+			return nil, fmt.Errorf("division by zero in %v %s %v", l, op, r)
+		}
+		if op == "/" {
+			return x / y, nil
+		}
+		return math.Mod(x, y), nil
+	}
+
+	xneg, x := magnitude(lv)
+	yneg, y := magnitude(rv)
+	if (op == "/" || op == "%") && y == 0 {
+		return nil, fmt.Errorf("division by zero in %v %s %v", l, op, r)
+	}
+	val, ok := intArith(op, xneg, x, yneg, y)
+	if !ok {
+		return nil, fmt.Errorf("integer overflow in %v %s %v", l, op, r)
+	}
+	return val, nil
+}
+
+// Return an integer of any kind as its sign and magnitude, so that signed
+// and unsigned integers can be computed together.
+func magnitude(v reflect.Value) (neg bool, mag uint64) {
+	if isUnsigned(v.Kind()) {
+		return false, v.Uint()
+	}
+	if i := v.Int(); i < 0 {
+		return true, uint64(-i)
+	}
+	return false, uint64(v.Int())
+}
+
+// Compute x op y for integers given as signs and magnitudes, and return
+// whether the result fits in an int64 or a uint64.
+func intArith(op string, xneg bool, x uint64, yneg bool, y uint64) (interface{}, bool) {
+	var z, carry uint64
+	var neg bool
+	switch op {
+	case "-":
+		yneg = !yneg
+		fallthrough
+	case "+":
+		switch {
+		case xneg == yneg:
+			z, carry = bits.Add64(x, y, 0)
+			neg = xneg
+		case x >= y:
+			z, neg = x-y, xneg
 		default:
-			fmt.Printf("Unknown arg type %v\n", arg)
+			z, neg = y-x, yneg
 		}
+	case "*":
+		carry, z = bits.Mul64(x, y)
+		neg = xneg != yneg
+	case "/":
+		z, neg = x/y, xneg != yneg
+	case "%":
+		z, neg = x%y, xneg
+	}
+	switch {
+	case carry != 0, neg && z > 1<<63:
+		return nil, false
+	case neg:
+		return -int64(z), true
+	case z > math.MaxInt64:
+		return z, true
 	}
+	return int64(z), true
+}
 
-	retval := filterVal.Call(argvals)[0]
-	return retval.Interface(), nil
+// Concatenate l and r as strings.  If either is a SafeString, the other is
+// escaped, and the result is a SafeString.
+func concat(l, r interface{}) interface{} {
+	_, lsafe := l.(SafeString)
+	_, rsafe := r.(SafeString)
+	ls, rs := fmt.Sprint(l), fmt.Sprint(r)
+	if !lsafe && !rsafe {
+		return ls + rs
+	}
+	if !lsafe {
+		ls = escapeString(ls)
+	}
+	if !rsafe {
+		rs = escapeString(rs)
+	}
+	return SafeString(ls + rs)
 }
 
-// Evaluate a varExpr given the contexts.  Return a string and possible error
-func (v *varExpr) Eval(contexts []interface{}) (interface{}, error) {
-	var err error
-	expr := v.exprs[0].(*lookupExpr)
-	val := lookup(contexts, expr.name)
+func emptyIfNil(v interface{}) interface{} {
+	if v == nil {
+		return ""
+	}
+	return v
+}
+
+func isFloat(k reflect.Kind) bool {
+	return k == reflect.Float32 || k == reflect.Float64
+}
 
-	if !val.IsValid() {
-		return "", errors.New("Invalid value in lookup.")
+// Evaluate a value, which is a literal, a varExpr or an arithExpr.
+func evalValue(s *state, expr interface{}, contexts []interface{}) (interface{}, error) {
+	switch v := expr.(type) {
+	case *varExpr:
+		return v.Eval(s, contexts)
+	case *arithExpr:
+		return v.Eval(s, contexts)
 	}
+	return expr, nil
+}
 
-	inter := val.Interface()
+// Evaluate a varExpr given the contexts.  Return a string and possible error.
+// Outside of strict mode, names which aren't found and unknown filters
+// evaluate to an empty string.  A nil value also evaluates to an empty string.
+func (v *varExpr) Eval(s *state, contexts []interface{}) (interface{}, error) {
+	val, err := v.eval(s, contexts)
+	if _, ok := err.(strictError); ok && !s.strict {
+		return "", nil
+	}
+	if err == nil && val == nil {
+		return "", nil
+	}
+	return val, err
+}
 
-	for _, exp := range v.exprs[1:] {
-		filter := exp.(*funcExpr)
-		inter, err = filter.Apply(contexts, inter)
-		if err != nil {
+// If a name isn't found or a filter fails, evaluation skips to the next
+// default filter, which is applied to nil.  Without one, the lookup or
+// filter's error is returned;  a name which isn't found is a strictError.
+func (v *varExpr) eval(s *state, contexts []interface{}) (interface{}, error) {
+	inter, err := evalOperand(s, v.exprs[0], contexts)
+	i := 1
+	if err != nil {
+		if i = v.fallback(i); i < 0 {
 			return "", err
 		}
+		inter = nil
 	}
-	if inter == nil {
-		return "", nil
+
+	for i < len(v.exprs) {
+		filter := v.exprs[i].(*funcExpr)
+		inter, err = filter.Apply(s, contexts, inter)
+		if err != nil {
+			if i = v.fallback(i + 1); i < 0 {
+				return "", err
+			}
+			inter = nil
+			continue
+		}
+		i++
 	}
 	return inter, nil
 }
+
+// Return the index of the first default filter in v at or after start, or
+// -1 if there isn't one.
+func (v *varExpr) fallback(start int) int {
+	for i := start; i < len(v.exprs); i++ {
+		if f, ok := v.exprs[i].(*funcExpr); ok && f.name == "default" {
+			return i
+		}
+	}
+	return -1
+}
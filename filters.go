@@ -2,36 +2,22 @@ package mandira
 
 import (
 	"fmt"
+	"html"
 	"reflect"
-	"runtime"
 	"strings"
 	"time"
 )
 
-var filters = map[string]interface{}{}
-
-func AddFilter(filter interface{}, name ...string) {
-	/* FIXME: typecheck */
-	var fname string
-	if len(name) == 1 {
-		fname = name[0]
-	} else {
-		val := reflect.ValueOf(filter)
-		// this returns something like: /jmoiron/devel/mandira.Len
-		spl := strings.Split(runtime.FuncForPC(val.Pointer()).Name(), ".")
-		fname = strings.ToLower(spl[len(spl)-1])
-	}
-
-	filters[fname] = filter
+// Add a filter to DefaultEnv.  If no name is given, the filter is named
+// after its function, in lower case.  An error is returned if filter is not
+// a function which can be used as a filter.
+func AddFilter(filter interface{}, name ...string) error {
+	return DefaultEnv.AddFilter(filter, name...)
 }
 
-// Return a filter (or nil)
+// Return a filter from DefaultEnv (or nil)
 func GetFilter(name string) interface{} {
-	filter, ok := filters[name]
-	if !ok {
-		return nil
-	}
-	return filter
+	return DefaultEnv.GetFilter(name)
 }
 
 // Return the length of the argument, or 0 if that is not a valid action
@@ -46,7 +32,11 @@ func Len(arg interface{}) int {
 
 // Return the index of the argument at arg I
 func Index(arg interface{}, idx_ interface{}) interface{} {
-	idx := int(idx_.(int64))
+	iv := reflect.ValueOf(idx_)
+	if !isNumber(iv.Kind()) || iv.Convert(reflect.TypeOf(0.0)).Float() < 0 {
+		return ""
+	}
+	idx := int(iv.Convert(reflect.TypeOf(0)).Int())
 	val := reflect.ValueOf(arg)
 	switch val.Kind() {
 	case reflect.Array, reflect.Slice:
@@ -87,20 +77,57 @@ func Join(arg interface{}, joiner string) string {
 	return strings.Join(slist, joiner)
 }
 
+// Truncate arg to at most length characters, replacing the end with "..." if
+// it is cut.  A SafeString is cut in its unescaped text, so an entity counts
+// as one character and is never split, and the result is escaped again;  any
+// markup which is cut is escaped rather than left unclosed.
+func Truncate(arg interface{}, length int) interface{} {
+	text := fmt.Sprint(arg)
+	safe, isSafe := arg.(SafeString)
+	if isSafe {
+		text = html.UnescapeString(string(safe))
+	}
+	runes := []rune(text)
+	if len(runes) <= length {
+		return arg
+	}
+	cut := length - 3
+	if cut < 0 {
+		cut = 0
+	}
+	truncated := string(runes[:cut]) + "..."
+	if isSafe {
+		return SafeString(escapeString(truncated))
+	}
+	return truncated
+}
+
+// Return def if arg is nil or an empty string, and arg otherwise.  Names
+// which aren't found and filters which fail evaluate to nil before a default
+// filter, so it can be used as a fallback.
+func Default(arg, def interface{}) interface{} {
+	if arg == nil || arg == "" {
+		return def
+	}
+	return arg
+}
+
 func DivisibleBy(base_, by_ interface{}) bool {
 	base := reflect.ValueOf(base_).Int()
 	by := reflect.ValueOf(by_).Int()
 	return base%by == 0
 }
 
-func init() {
-	AddFilter(strings.ToUpper, "upper")
-	AddFilter(strings.ToLower, "lower")
-	AddFilter(strings.Title, "title")
-	AddFilter(Len)
-	AddFilter(Index)
-	AddFilter(Format)
-	AddFilter(Date)
-	AddFilter(Join)
-	AddFilter(DivisibleBy)
+func addBuiltinFilters(e *Env) {
+	e.AddFilter(strings.ToUpper, "upper")
+	e.AddFilter(strings.ToLower, "lower")
+	e.AddFilter(strings.Title, "title")
+	e.AddFilter(Len)
+	e.AddFilter(Index)
+	e.AddFilter(Format)
+	e.AddFilter(Date)
+	e.AddFilter(Join)
+	e.AddFilter(DivisibleBy)
+	e.AddFilter(Default)
+	e.AddFilter(Truncate)
 }
@@ -0,0 +1,164 @@
+package mandira
+
+import (
+	"fmt"
+	"strings"
+)
+
+/* Template inheritance.
+
+A template may name a parent layout with an extends tag and override any of
+the parent's named blocks:
+
+	{{% extends "base" }}
+	{{% block title }}My Page - {{% super }}{{/block}}
+
+Blocks are sectionElements.  When the child is parsed, the parent's element
+tree is copied with its blocks replaced by the child's overrides, so the
+result renders in a single pass.  The super tag renders the parent's version
+of the enclosing block.  Content in the child outside of blocks is ignored.
+
+*/
+
+// parse a {{% ... }} tag;  tag is the contents following the %
+func (p *parser) parseInheritanceTag(tag string, section ...*sectionElement) error {
+	var current *sectionElement
+	elems := &p.tmpl.elems
+
+	if len(section) == 1 {
+		current = section[0]
+		elems = current.target()
+	}
+
+	fields := strings.Fields(tag)
+	if len(fields) == 0 {
+		return parseError{p.curline, "empty tag"}
+	}
+
+	switch fields[0] {
+	case "extends":
+		if len(fields) != 2 {
+			return parseError{p.curline, "extends requires a template name"}
+		}
+		if current != nil {
+			return parseError{p.curline, "extends must not be in a section"}
+		}
+		if len(p.extends) > 0 {
+			return parseError{p.curline, "template extends more than one layout"}
+		}
+		p.extends = strings.Trim(fields[1], `"`)
+	case "block":
+		if len(fields) != 2 {
+			return parseError{p.curline, "block requires a name"}
+		}
+		se := &sectionElement{name: "block", block: fields[1], pos: p.pos("%" + tag)}
+		p.blocks = append(p.blocks, se.block)
+		err := p.parseSection(se)
+		p.blocks = p.blocks[:len(p.blocks)-1]
+		if err != nil {
+			return err
+		}
+		*elems = append(*elems, se)
+	case "super":
+		if len(p.blocks) == 0 {
+			return parseError{p.curline, "super outside of a block"}
+		}
+		block := p.blocks[len(p.blocks)-1]
+		*elems = append(*elems, &sectionElement{name: "super", block: block, super: true, pos: p.pos("%" + tag)})
+	default:
+		return parseError{p.curline, "invalid tag: %" + tag}
+	}
+	return nil
+}
+
+// Replace the elements of the template with those of the parent layout,
+// substituting the blocks defined in the template.
+func (p *parser) inherit() error {
+	parent, err := p.resolver.Resolve(p.extends)
+	if err != nil {
+		return parseError{p.curline, fmt.Sprintf("extends %q: %s", p.extends, err)}
+	}
+
+	overrides := map[string]*sectionElement{}
+	collectBlocks(p.tmpl.elems, overrides)
+	supers := map[string]*sectionElement{}
+	collectBlocks(parent.elems, supers)
+
+	p.tmpl.elems = substituteBlocks(parent.elems, overrides, supers)
+	return nil
+}
+
+// Add all of the blocks in elems to blocks, keyed by name.
+func collectBlocks(elems []interface{}, blocks map[string]*sectionElement) {
+	for _, elem := range elems {
+		se, ok := elem.(*sectionElement)
+		if !ok || se.super {
+			continue
+		}
+		if len(se.block) > 0 {
+			blocks[se.block] = se
+		}
+		collectBlocks(se.elems, blocks)
+		for _, elif := range se.elifs {
+			collectBlocks(elif.elems, blocks)
+		}
+		collectBlocks(se.elseElems, blocks)
+	}
+}
+
+// Return a copy of elems with each block replaced by its override, if there
+// is one.  The elements themselves are not modified, as they may belong to a
+// template which is shared.
+func substituteBlocks(elems []interface{}, overrides, supers map[string]*sectionElement) []interface{} {
+	ret := make([]interface{}, 0, len(elems))
+	for _, elem := range elems {
+		se, ok := elem.(*sectionElement)
+		if !ok || se.super {
+			ret = append(ret, elem)
+			continue
+		}
+		if override, ok := overrides[se.block]; ok && len(se.block) > 0 {
+			ret = append(ret, resolveSupers(override, supers))
+			continue
+		}
+		cp := *se
+		cp.elems = substituteBlocks(se.elems, overrides, supers)
+		cp.elifs = nil
+		for _, elif := range se.elifs {
+			cp.elifs = append(cp.elifs, &condBranch{elif.expr, substituteBlocks(elif.elems, overrides, supers), elif.pos})
+		}
+		cp.elseElems = substituteBlocks(se.elseElems, overrides, supers)
+		ret = append(ret, &cp)
+	}
+	return ret
+}
+
+// Return a copy of section with each super tag within it pointing at the
+// parent's version of its block.
+func resolveSupers(section *sectionElement, supers map[string]*sectionElement) *sectionElement {
+	cp := *section
+	if cp.super {
+		if parent, ok := supers[cp.block]; ok {
+			cp.elems = parent.elems
+		}
+		return &cp
+	}
+	cp.elems = resolveSupersIn(section.elems, supers)
+	cp.elifs = nil
+	for _, elif := range section.elifs {
+		cp.elifs = append(cp.elifs, &condBranch{elif.expr, resolveSupersIn(elif.elems, supers), elif.pos})
+	}
+	cp.elseElems = resolveSupersIn(section.elseElems, supers)
+	return &cp
+}
+
+func resolveSupersIn(elems []interface{}, supers map[string]*sectionElement) []interface{} {
+	ret := make([]interface{}, 0, len(elems))
+	for _, elem := range elems {
+		if se, ok := elem.(*sectionElement); ok {
+			elem = resolveSupers(se, supers)
+		}
+		ret = append(ret, elem)
+	}
+	return ret
+}
@@ -0,0 +1,199 @@
+package mandira
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+)
+
+// An Iterator is a sequence which a section can iterate over without
+// collecting its items first.  Next returns the next item, or false when
+// there are no more.
+type Iterator interface {
+	Next() (interface{}, bool)
+}
+
+// Return a function which calls yield with the items of v, and their keys for
+// sequences of pairs, if v is a sequence which is streamed: an Iterator, a
+// channel which can be received from, or an iterator function like iter.Seq
+// or iter.Seq2.  Otherwise, return nil.  Iteration stops if yield returns
+// false.
+func sequence(v reflect.Value) func(yield func(key, item reflect.Value) bool) {
+	if v.IsValid() && v.CanInterface() {
+		if it, ok := v.Interface().(Iterator); ok {
+			return func(yield func(key, item reflect.Value) bool) {
+				for item, ok := it.Next(); ok; item, ok = it.Next() {
+					if !yield(reflect.Value{}, reflect.ValueOf(item)) {
+						return
+					}
+				}
+			}
+		}
+	}
+
+	v = indirect(v)
+	if !v.IsValid() {
+		return nil
+	}
+	switch t := v.Type(); {
+	case t.Kind() == reflect.Chan && t.ChanDir()&reflect.RecvDir != 0:
+		return func(yield func(key, item reflect.Value) bool) {
+			for item, ok := v.Recv(); ok; item, ok = v.Recv() {
+				if !yield(reflect.Value{}, item) {
+					return
+				}
+			}
+		}
+	case t.Kind() == reflect.Func && t.CanSeq2():
+		return func(yield func(key, item reflect.Value) bool) {
+			for key, item := range v.Seq2() {
+				if !yield(key, item) {
+					return
+				}
+			}
+		}
+	case t.Kind() == reflect.Func && t.CanSeq():
+		return func(yield func(key, item reflect.Value) bool) {
+			for item := range v.Seq() {
+				if !yield(reflect.Value{}, item) {
+					return
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Render elems for each item of seq.  Its length isn't known, but each item
+// is read before the previous one is rendered, so that .last is.
+func (s *state) renderSequence(seq func(yield func(key, item reflect.Value) bool), elems []interface{}, contextChain []interface{}, buf io.Writer) error {
+	chain := make([]interface{}, len(contextChain)+1)
+	copy(chain[1:], contextChain)
+
+	var err error
+	var pending *listContext
+	render := func() bool {
+		chain[0] = pending
+		err = s.renderElements(elems, chain, buf)
+		return err == nil
+	}
+
+	index := 0
+	seq(func(key, item reflect.Value) bool {
+		if pending != nil && !render() {
+			return false
+		}
+		pending = &listContext{index: index, length: -1, context: item, key: key}
+		index++
+		return true
+	})
+	if err == nil && pending != nil {
+		pending.last = true
+		render()
+	}
+	return err
+}
+
+// Return the entries of the map m as list contexts, sorted by order, which is
+// "key", "value" or "natural".  Keys are compared as numbers, strings or bools
+// when they are of those kinds;  natural order compares runs of digits within
+// keys by their numeric value, so "item2" sorts before "item10".  Entries with
+// equal values are sorted by key, so the order is always the same.
+func mapEntries(m reflect.Value, order string) []interface{} {
+	keys := m.MapKeys()
+	switch order {
+	case "natural":
+		sort.Slice(keys, func(i, j int) bool {
+			return naturalLess(fmt.Sprint(keys[i].Interface()), fmt.Sprint(keys[j].Interface()))
+		})
+	default:
+		sort.Slice(keys, func(i, j int) bool { return lessValue(keys[i], keys[j]) })
+	}
+	if order == "value" {
+		sort.SliceStable(keys, func(i, j int) bool { return lessValue(m.MapIndex(keys[i]), m.MapIndex(keys[j])) })
+	}
+
+	entries := make([]interface{}, len(keys))
+	for i, key := range keys {
+		entries[i] = &listContext{index: i, length: len(keys), last: i == len(keys)-1, context: m.MapIndex(key), key: key}
+	}
+	return entries
+}
+
+// Return whether a sorts before b.  Numbers of any kind are compared by value,
+// and strings and bools in the usual way;  other values are compared by their
+// formatted value.
+func lessValue(a, b reflect.Value) bool {
+	a, b = indirect(a), indirect(b)
+	if !a.IsValid() || !b.IsValid() {
+		return !a.IsValid() && b.IsValid()
+	}
+	switch {
+	case isNumber(a.Kind()) && isNumber(b.Kind()):
+		return toFloat(a) < toFloat(b)
+	case a.Kind() == reflect.String && b.Kind() == reflect.String:
+		return a.String() < b.String()
+	case a.Kind() == reflect.Bool && b.Kind() == reflect.Bool:
+		return !a.Bool() && b.Bool()
+	}
+	return fmt.Sprint(a.Interface()) < fmt.Sprint(b.Interface())
+}
+
+// Return the value of a number of any kind as a float64.
+func toFloat(v reflect.Value) float64 {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int())
+	case reflect.Uint, reflect.Uintptr, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(v.Uint())
+	}
+	return v.Float()
+}
+
+// Return whether a sorts before b in natural order, where runs of digits are
+// compared by their numeric value.  Strings which are equal in natural order,
+// like "a2" and "a02", are compared as strings.
+func naturalLess(a, b string) bool {
+	x, y := a, b
+	for len(x) > 0 && len(y) > 0 {
+		if isDigit(x[0]) && isDigit(y[0]) {
+			i, j := digits(x), digits(y)
+			nx, ny := trimZeros(x[:i]), trimZeros(y[:j])
+			if len(nx) != len(ny) {
+				return len(nx) < len(ny)
+			}
+			if nx != ny {
+				return nx < ny
+			}
+			x, y = x[i:], y[j:]
+			continue
+		}
+		if x[0] != y[0] {
+			return x[0] < y[0]
+		}
+		x, y = x[1:], y[1:]
+	}
+	if len(x) != len(y) {
+		return len(x) < len(y)
+	}
+	return a < b
+}
+
+func isDigit(c byte) bool { return c >= '0' && c <= '9' }
+
+// Return the length of the run of digits at the start of s.
+func digits(s string) int {
+	i := 0
+	for i < len(s) && isDigit(s[i]) {
+		i++
+	}
+	return i
+}
+
+func trimZeros(s string) string {
+	for len(s) > 1 && s[0] == '0' {
+		s = s[1:]
+	}
+	return s
+}
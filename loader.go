@@ -2,16 +2,27 @@ package mandira
 
 import (
 	"errors"
+	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 )
 
+// A Loader loads templates from a directory.  It is safe to use a Loader
+// from multiple goroutines, but its fields should not be modified once it
+// is in use.
 type Loader struct {
 	Path    string
 	Preload bool
 	Loaded  bool
-	cache   map[string]*Template
+	// Env templates are parsed in, or DefaultEnv if nil;  partials are
+	// always resolved through the loader
+	Env *Env
+	// mu protects cache and Loaded
+	mu    sync.RWMutex
+	cache map[string]*Template
 }
 
 func anysuffix(has string, any ...string) bool {
@@ -28,7 +39,11 @@ func IsTemplate(path string) bool {
 }
 
 func NewLoader(path string, preload bool) *Loader {
-	loader := &Loader{Path: path, Preload: preload}
+	return newLoader(path, preload, nil)
+}
+
+func newLoader(path string, preload bool, env *Env) *Loader {
+	loader := &Loader{Path: path, Preload: preload, Env: env}
 	loader.cache = map[string]*Template{}
 	if preload {
 		loader.Refresh()
@@ -36,29 +51,74 @@ func NewLoader(path string, preload bool) *Loader {
 	return loader
 }
 
-func (l *Loader) visitor(path string, f os.FileInfo, err error) error {
-	if err != nil || f == nil {
-		return nil
+// Return the template cached under path, if there is one.
+func (l *Loader) cached(path string) (*Template, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	tpl, ok := l.cache[path]
+	return tpl, ok
+}
+
+// Cache a template under path.
+func (l *Loader) store(path string, tpl *Template) {
+	l.mu.Lock()
+	l.cache[path] = tpl
+	l.mu.Unlock()
+}
+
+// parse a file whose partials resolve through the loader.  parents are the
+// names of the templates currently being parsed, and refresh is the cache
+// being built by Refresh, if there is one.
+func (l *Loader) parseFile(filename string, parents []string, refresh map[string]*Template) (*Template, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
 	}
-	if f.Mode().IsRegular() && IsTemplate(path) {
-		tpl, err := ParseFile(path)
+	name := strings.TrimPrefix(strings.TrimPrefix(filename, l.Path), "/")
+	return parseTemplate(name, string(data), l.env(), &loaderResolver{l, parents, refresh})
+}
+
+// Refresh parses all of the templates under the loader's path.  Templates
+// are parsed into a new cache without holding the loader's lock, so the
+// loader can be used while it refreshes, and partials resolve to their
+// refreshed versions.  The new cache replaces the old one when the walk is
+// done;  templates added to the loader which are not files are kept.
+func (l *Loader) Refresh() error {
+	cache := map[string]*Template{}
+	err := filepath.Walk(l.Path, func(path string, f os.FileInfo, err error) error {
+		if err != nil || f == nil || !f.Mode().IsRegular() || !IsTemplate(path) {
+			return nil
+		}
+		name := strings.TrimPrefix(path, l.Path)
+		// partials are cached when the templates including them are parsed
+		if _, ok := cache[name]; ok {
+			return nil
+		}
+		tpl, err := l.parseFile(path, []string{strings.TrimPrefix(name, "/")}, cache)
 		if err != nil {
 			return err
 		}
-		l.cache[strings.TrimPrefix(path, l.Path)] = tpl
+		cache[name] = tpl
+		return nil
+	})
+	l.mu.Lock()
+	for name, tpl := range l.cache {
+		if _, ok := cache[name]; !ok {
+			cache[name] = tpl
+		}
 	}
-	return nil
-}
-
-func (l *Loader) Refresh() error {
-	err := filepath.Walk(l.Path, l.visitor)
+	l.cache = cache
 	l.Loaded = true
+	l.mu.Unlock()
 	return err
 }
 
 func (l *Loader) Get(path string) (*Template, error) {
 	var err error
-	if l.Preload && !l.Loaded {
+	l.mu.RLock()
+	loaded := l.Loaded
+	l.mu.RUnlock()
+	if l.Preload && !loaded {
 		err = l.Refresh()
 		if err != nil {
 			return nil, err
@@ -66,14 +126,19 @@ func (l *Loader) Get(path string) (*Template, error) {
 	}
 
 	if l.Preload {
-		tpl, ok := l.cache[path]
+		tpl, ok := l.cached(path)
 		if !ok {
 			return nil, errors.New("Template " + path + " does not exist or cannot be loaded.")
 		}
 		return tpl, nil
 	}
 
-	return ParseFile(filepath.Join(l.Path, path))
+	// templates added to a loader which doesn't preload are still cached
+	if tpl, ok := l.cached(path); ok {
+		return tpl, nil
+	}
+
+	return l.parseFile(filepath.Join(l.Path, path), []string{path}, nil)
 }
 
 func (l *Loader) MustGet(path string) *Template {
@@ -84,13 +149,108 @@ func (l *Loader) MustGet(path string) *Template {
 	return t
 }
 
-// Return the internal cache
+// Return a copy of the internal cache
 func (l *Loader) Cache() map[string]*Template {
-	return l.cache
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	cache := make(map[string]*Template, len(l.cache))
+	for k, v := range l.cache {
+		cache[k] = v
+	}
+	return cache
 }
 
 // If you want to add a template sourced from elsewhere to the loader, you
 // can do it here and continue to use the loader.
 func (l *Loader) Add(path string, template *Template) {
-	l.cache[path] = template
+	l.store(path, template)
+}
+
+// Parse a template from a string.  Partials in the template are resolved
+// through the loader, so they can name templates which were added to it.
+func (l *Loader) ParseString(data string) (*Template, error) {
+	return parseTemplate("", data, l.env(), &loaderResolver{l: l})
+}
+
+// Return the environment templates are parsed in.
+func (l *Loader) env() *Env {
+	if l.Env == nil {
+		return DefaultEnv
+	}
+	return l.Env
+}
+
+// Resolve finds the template for a partial.  The name is looked up in the
+// loader's cache, with and without a template extension, and then read
+// from the loader's path.
+func (l *Loader) Resolve(name string) (*Template, error) {
+	r := loaderResolver{l: l}
+	return r.Resolve(name)
+}
+
+// loaderResolver resolves partials through a loader.  parents are the names
+// of the templates currently being parsed, and are used to detect cyclic
+// includes.  While the loader refreshes, refresh is the new cache, and
+// partials are looked up there, then on disk, and then in the old cache.
+type loaderResolver struct {
+	l       *Loader
+	parents []string
+	refresh map[string]*Template
+}
+
+// Return the cached template named n in the cache being resolved against.
+func (r *loaderResolver) cached(n string) (*Template, bool) {
+	if r.refresh != nil {
+		tpl, ok := r.refresh[n]
+		return tpl, ok
+	}
+	return r.l.cached(n)
+}
+
+func (r *loaderResolver) Resolve(name string) (*Template, error) {
+	l := r.l
+	names := []string{name, name + ".mnd", name + ".mandira", name + ".mda"}
+	for _, n := range names {
+		// cache keys keep the leading slash when Path has no trailing slash
+		if tpl, ok := r.cached(n); ok {
+			return tpl, nil
+		}
+		if tpl, ok := r.cached("/" + n); ok {
+			return tpl, nil
+		}
+	}
+
+	for _, n := range names {
+		filename := filepath.Join(l.Path, n)
+		if f, err := os.Stat(filename); err != nil || !f.Mode().IsRegular() {
+			continue
+		}
+		for _, parent := range r.parents {
+			if parent == n {
+				return nil, fmt.Errorf("cyclic partial %q", name)
+			}
+		}
+		tpl, err := l.parseFile(filename, append(r.parents[:len(r.parents):len(r.parents)], n), r.refresh)
+		if err != nil {
+			return nil, err
+		}
+		if r.refresh != nil {
+			r.refresh[strings.TrimPrefix(filename, l.Path)] = tpl
+		} else if l.Preload {
+			l.store(strings.TrimPrefix(filename, l.Path), tpl)
+		}
+		return tpl, nil
+	}
+
+	if r.refresh != nil {
+		for _, n := range names {
+			if tpl, ok := l.cached(n); ok {
+				return tpl, nil
+			}
+			if tpl, ok := l.cached("/" + n); ok {
+				return tpl, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("Could not find partial %q", name)
 }
@@ -0,0 +1,171 @@
+package mandira
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestLoaderPartials(t *testing.T) {
+	dir := writeTemplates(t, map[string]string{
+		"page.mnd":   `{{>header}}{{name}}`,
+		"header.mnd": `<h1>{{title}}</h1>`,
+		"a.mnd":      `a{{>b}}`,
+		"b.mnd":      `b{{>a}}`,
+	})
+	defer os.RemoveAll(dir)
+
+	// templates added to the loader never touch the disk
+	loader := NewLoader(filepath.Join(dir, "empty"), false)
+	footer, err := ParseString(`<p>{{name}}</p>`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loader.Add("footer", footer)
+	tmpl, err := loader.ParseString(`{{title}}{{>footer}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out := tmpl.Render(M{"title": "Hi", "name": "Bob"}); out != "Hi<p>Bob</p>" {
+		t.Errorf("expected %q, got %q", "Hi<p>Bob</p>", out)
+	}
+
+	loader = NewLoader(dir, false)
+	tmpl, err = loader.Get("page.mnd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out := tmpl.Render(M{"title": "Hi", "name": "Bob"}); out != "<h1>Hi</h1>Bob" {
+		t.Errorf("expected %q, got %q", "<h1>Hi</h1>Bob", out)
+	}
+	if _, err = loader.Get("a.mnd"); err == nil {
+		t.Errorf("expected an error parsing cyclic partials")
+	}
+	if _, err = loader.ParseString(`{{>nope}}`); err == nil {
+		t.Errorf("expected an error parsing a missing partial")
+	}
+}
+
+func TestLoaderRefresh(t *testing.T) {
+	dir := writeTemplates(t, map[string]string{
+		"a.mnd": `A{{>b}}`,
+		"b.mnd": `old`,
+	})
+	defer os.RemoveAll(dir)
+
+	loader := NewLoader(dir, true)
+	loader.Add("footer", loader.MustGet("/b.mnd"))
+	if out := loader.MustGet("/a.mnd").Render(); out != "Aold" {
+		t.Fatalf("expected %q, got %q", "Aold", out)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "b.mnd"), []byte(`new`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := loader.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	// templates which include an edited partial see its new version
+	for name, expected := range map[string]string{"/a.mnd": "Anew", "/b.mnd": "new", "footer": "old"} {
+		if out := loader.MustGet(name).Render(); out != expected {
+			t.Errorf("%s: expected %q, got %q", name, expected, out)
+		}
+	}
+}
+
+func TestInheritance(t *testing.T) {
+	loader := NewLoader("", false)
+	add := func(name, data string) {
+		tmpl, err := loader.ParseString(data)
+		if err != nil {
+			t.Fatalf("parsing %s: %v", name, err)
+		}
+		loader.Add(name, tmpl)
+	}
+	add("base", `<title>{{% block title }}Site{{/block}}</title>`+
+		`{{% block body }}{{?if sidebar}}{{% block side }}side{{/block}}{{/if}}{{/block}}`)
+	add("blog", `{{% extends "base" }}ignored{{% block title }}Blog - {{% super }}{{/block}}`)
+	add("post", `{{% extends blog }}{{% block title }}{{title}} | {{% super }}{{/block}}`+
+		`{{% block side }}[{{% super }}]{{/block}}`)
+
+	tests := []struct {
+		name     string
+		context  interface{}
+		expected string
+	}{
+		{"base", M{}, "<title>Site</title>"},
+		{"base", M{"sidebar": true}, "<title>Site</title>side"},
+		{"blog", M{"sidebar": true}, "<title>Blog - Site</title>side"},
+		{"post", M{"title": "Hello", "sidebar": true}, "<title>Hello | Blog - Site</title>[side]"},
+		{"post", M{"title": "Hello"}, "<title>Hello | Blog - Site</title>"},
+	}
+	for _, test := range tests {
+		tmpl, err := loader.Get(test.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out := tmpl.Render(test.context); out != test.expected {
+			t.Errorf("%s: expected %q, got %q", test.name, test.expected, out)
+		}
+	}
+
+	// the parent layouts are not modified by their children
+	if out := loader.MustGet("blog").Render(M{}); out != "<title>Blog - Site</title>" {
+		t.Errorf("expected blog to be unchanged, got %q", out)
+	}
+
+	errs := []string{
+		`{{% super }}`,
+		`{{% extends "nope" }}`,
+		`{{#a}}{{% extends "base" }}{{/a}}`,
+		`{{% block }}{{/block}}`,
+		`{{% extends "base" }}{{% extends "blog" }}`,
+	}
+	for _, e := range errs {
+		if _, err := loader.ParseString(e); err == nil {
+			t.Errorf("expected parse error for %q", e)
+		}
+	}
+}
+
+// Run with -race to check that loaders can be shared between goroutines.
+func TestLoaderConcurrency(t *testing.T) {
+	dir := writeTemplates(t, map[string]string{
+		"page.mnd":   `{{>header}}{{name}}`,
+		"header.mnd": `<h1>{{title}}</h1>`,
+	})
+	defer os.RemoveAll(dir)
+
+	loader := NewLoader(dir+"/", true)
+	footer, _ := ParseString(`<p>{{name}}</p>`)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				switch (i + j) % 4 {
+				case 0:
+					if err := loader.Refresh(); err != nil {
+						t.Error(err)
+					}
+				case 1:
+					loader.Add(fmt.Sprintf("footer%d", j), footer)
+				case 2:
+					loader.Cache()
+				}
+				tmpl, err := loader.Get("page.mnd")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if out := tmpl.Render(M{"title": "Hi", "name": "Bob"}); out != "<h1>Hi</h1>Bob" {
+					t.Errorf("expected %q, got %q", "<h1>Hi</h1>Bob", out)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
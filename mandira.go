@@ -2,13 +2,12 @@ package mandira
 
 import (
 	"bytes"
-	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"os"
 	"path"
 	"reflect"
+	"strconv"
 	"strings"
 )
 
@@ -19,33 +18,187 @@ type textElement struct {
 type varElement struct {
 	expr *varExpr
 	raw  bool
+	pos  position
 }
 
+// A listContext is an item in a list being iterated by a section, with the
+// item's index and the length of the list for loop metadata.  The length of
+// sequences which are streamed is not known, and is -1.
 type listContext struct {
 	index   int
+	length  int
+	last    bool
 	context interface{}
+	// the key of a map entry, which is invalid for other lists
+	key reflect.Value
+}
+
+// Return the loop metadata called name, and whether there is any.  Odd and
+// even count from the first item, which is odd.  Map entries also have a key
+// and a value.  Metadata which depends on the length of a list is missing
+// when the length isn't known.
+func (lc *listContext) meta(name string) (reflect.Value, bool) {
+	i, n := lc.index, lc.length
+	if n < 0 {
+		switch name {
+		case ".length", ".revindex", ".revindex1":
+			return reflect.Value{}, false
+		}
+	}
+	var meta interface{}
+	switch name {
+	case ".index":
+		meta = i
+	case ".index1":
+		meta = i + 1
+	case ".first":
+		meta = i == 0
+	case ".last":
+		meta = lc.last
+	case ".length":
+		meta = n
+	case ".revindex":
+		meta = n - i - 1
+	case ".revindex1":
+		meta = n - i
+	case ".odd":
+		meta = i%2 == 0
+	case ".even":
+		meta = i%2 == 1
+	case ".key":
+		return lc.key, lc.key.IsValid()
+	case ".value":
+		return lc.context.(reflect.Value), true
+	default:
+		return reflect.Value{}, false
+	}
+	return reflect.ValueOf(meta), true
 }
 
 type sectionElement struct {
 	name          string
-	startline     int
+	pos           position
 	isConditional bool
+	inverted      bool
 	hasElse       bool
-	expr          *conditional
+	expr          condition
 	elems         []interface{}
+	elifs         []*condBranch
 	elseElems     []interface{}
+	// block is the name of an inheritable block;  if super is set, this
+	// element stands in for the parent template's version of that block
+	block string
+	super bool
+	// each sections iterate over the value named by source, with map
+	// entries sorted by order
+	each   bool
+	source string
+	order  string
+	// with sections bind names to the values of expressions
+	bindings []*keywordArg
+	// capture sections bind their rendered elements to a name
+	capture string
+}
+
+// A captureContext binds the output of a capture section to a name in the
+// context chain.  It is not a level of the chain for ../ lookups.
+type captureContext struct {
+	name  string
+	value reflect.Value
 }
 
+// A SafeString is a string which is already escaped, and is rendered as it
+// is.  The output of capture sections is bound as a SafeString, and strings
+// which filters or concatenation make from a SafeString stay safe.
+type SafeString string
+
+// An elif branch of a conditional section
+type condBranch struct {
+	expr  condition
+	elems []interface{}
+	pos   position
+}
+
+// Return the list that elements parsed next in the section belong to.
+func (s *sectionElement) target() *[]interface{} {
+	if s.hasElse {
+		return &s.elseElems
+	}
+	if n := len(s.elifs); n > 0 {
+		return &s.elifs[n-1].elems
+	}
+	return &s.elems
+}
+
+// A Template is a parsed template.  Templates are not modified after they
+// are parsed, and are safe to render from multiple goroutines.
 type Template struct {
+	// the filename or loader path the template was parsed from, if any
+	name  string
+	env   *Env
+	elems []interface{}
+}
+
+// A parser holds the state used while parsing a template.
+type parser struct {
+	tmpl    *Template
 	data    string
 	otag    string
 	ctag    string
-	p       int
+	cur     int
 	curline int
-	dir     string
-	elems   []interface{}
+	// resolver finds the templates named by partial and extends tags
+	resolver Resolver
+	// the parent layout named by an extends tag, and the names of the
+	// blocks currently being parsed
+	extends string
+	blocks  []string
 }
 
+// The position of an element in the template it was parsed from, and the
+// text of its tag, for error messages.
+type position struct {
+	name string
+	line int
+	tag  string
+}
+
+// Return the position of a tag at the current line.
+func (p *parser) pos(tag string) position {
+	return position{p.tmpl.name, p.curline, tag}
+}
+
+// Wrap err in a RenderError at position p, unless it already is one.
+func (p position) wrap(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(*RenderError); ok {
+		return err
+	}
+	return &RenderError{Name: p.name, Line: p.line, Expr: p.tag, Err: err}
+}
+
+// A RenderError is returned when a template fails to render.  It records
+// the template's name, which is empty for templates parsed from strings,
+// the line of the failing tag, and the text of the tag.
+type RenderError struct {
+	Name string
+	Line int
+	Expr string
+	Err  error
+}
+
+func (e *RenderError) Error() string {
+	name := e.Name
+	if len(name) == 0 {
+		name = "template"
+	}
+	return fmt.Sprintf("%s:%d: {{%s}}: %s", name, e.Line, e.Expr, e.Err)
+}
+
+func (e *RenderError) Unwrap() error { return e.Err }
+
 type parseError struct {
 	line    int
 	message string
@@ -91,27 +244,34 @@ func htmlEscape(w io.Writer, s []byte) {
 	w.Write(s[last:])
 }
 
-func (tmpl *Template) readString(s string) (string, error) {
-	i := tmpl.p
+// Return s escaped for html.
+func escapeString(s string) string {
+	var buf bytes.Buffer
+	htmlEscape(&buf, []byte(s))
+	return buf.String()
+}
+
+func (p *parser) readString(s string) (string, error) {
+	i := p.cur
 	newlines := 0
-	for true {
+	for {
 		//are we at the end of the string?
-		if i+len(s) > len(tmpl.data) {
-			return tmpl.data[tmpl.p:], io.EOF
+		if i+len(s) > len(p.data) {
+			return p.data[p.cur:], io.EOF
 		}
 
-		if tmpl.data[i] == '\n' {
+		if p.data[i] == '\n' {
 			newlines++
 		}
 
-		if tmpl.data[i] != s[0] {
+		if p.data[i] != s[0] {
 			i++
 			continue
 		}
 
 		match := true
 		for j := 1; j < len(s); j++ {
-			if s[j] != tmpl.data[i+j] {
+			if s[j] != p.data[i+j] {
 				match = false
 				break
 			}
@@ -119,173 +279,259 @@ func (tmpl *Template) readString(s string) (string, error) {
 
 		if match {
 			e := i + len(s)
-			text := tmpl.data[tmpl.p:e]
-			tmpl.p = e
+			text := p.data[p.cur:e]
+			p.cur = e
 
-			tmpl.curline += newlines
+			p.curline += newlines
 			return text, nil
 		} else {
 			i++
 		}
 	}
-
-	//should never be here
-	return "", nil
-}
-
-func (tmpl *Template) parsePartial(name string) (*Template, error) {
-	filenames := []string{
-		path.Join(tmpl.dir, name),
-		path.Join(tmpl.dir, name+".mustache"),
-		path.Join(tmpl.dir, name+".stache"),
-		name,
-		name + ".mustache",
-		name + ".stache",
-	}
-	var filename string
-	for _, name := range filenames {
-		f, err := os.Open(name)
-		if err == nil {
-			filename = name
-			f.Close()
-			break
-		}
-	}
-	if filename == "" {
-		return nil, errors.New(fmt.Sprintf("Could not find partial %q", name))
-	}
-
-	partial, err := ParseFile(filename)
-
-	if err != nil {
-		return nil, err
-	}
-
-	return partial, nil
 }
 
 // Parses a tag.  If this is being done from within a section, append
 // the new elements to that section.  Otherwise, append the elements to
 // the template.
-func (tmpl *Template) parseTag(tag string, section ...*sectionElement) error {
+func (p *parser) parseTag(tag string, section ...*sectionElement) error {
 	var current *sectionElement
-	elems := &tmpl.elems
+	elems := &p.tmpl.elems
 
 	if len(section) == 1 {
 		current = section[0]
-		if current.hasElse {
-			elems = &current.elseElems
-		} else {
-			elems = &current.elems
-		}
+		elems = current.target()
 	}
 
 	if len(tag) == 0 {
-		return parseError{tmpl.curline, "empty tag"}
+		return parseError{p.curline, "empty tag"}
 	}
 
 	switch tag[0] {
 	case '!':
 		//ignore comment
 		break
-	case '#':
+	case '#', '^':
 		name := strings.TrimSpace(tag[1:])
+		pos := p.pos(tag)
 
 		//ignore the newline when a section starts
-		if len(tmpl.data) > tmpl.p && tmpl.data[tmpl.p] == '\n' {
-			tmpl.p += 1
-		} else if len(tmpl.data) > tmpl.p+1 && tmpl.data[tmpl.p] == '\r' && tmpl.data[tmpl.p+1] == '\n' {
-			tmpl.p += 2
+		if len(p.data) > p.cur && p.data[p.cur] == '\n' {
+			p.cur += 1
+			p.curline++
+		} else if len(p.data) > p.cur+1 && p.data[p.cur] == '\r' && p.data[p.cur+1] == '\n' {
+			p.cur += 2
+			p.curline++
 		}
 		se := sectionElement{}
 		se.name = name
-		se.startline = tmpl.curline
+		se.inverted = tag[0] == '^'
+		se.pos = pos
 		se.elems = []interface{}{}
-		err := tmpl.parseSection(&se)
+		if tag[0] == '#' && strings.HasPrefix(name, "each ") {
+			if err := p.parseEach(&se); err != nil {
+				return err
+			}
+		}
+		if tag[0] == '#' && strings.HasPrefix(name, "capture ") {
+			fields := strings.Fields(name)
+			if len(fields) != 2 {
+				return parseError{p.curline, "invalid capture section: " + name}
+			}
+			se.name, se.capture = "capture", fields[1]
+		}
+		if tag[0] == '#' && strings.HasPrefix(name, "with ") {
+			if err := p.parseWith(&se); err != nil {
+				return err
+			}
+		}
+		err := p.parseSection(&se)
 		if err != nil {
 			return err
 		}
 		*elems = append(*elems, &se)
 	case '?':
-		if tag[:4] == "?if " {
+		if strings.HasPrefix(tag, "?if ") {
 			se, err := parseCondElement(tag[4:])
 			if err != nil {
 				return err
 			}
+			if err = p.checkFilters(se.expr); err != nil {
+				return err
+			}
 			se.name = "if"
 			se.isConditional = true
-			se.startline = tmpl.curline
-			err = tmpl.parseSection(se)
+			se.pos = p.pos(tag)
+			err = p.parseSection(se)
 			if err != nil {
 				return err
 			}
 			*elems = append(*elems, se)
-		} else if tag[:5] == "?else" {
+		} else if strings.HasPrefix(tag, "?elif ") {
+			if current == nil || !current.isConditional {
+				return parseError{p.curline, "elif outside of an if section"}
+			}
+			if current.hasElse {
+				return parseError{p.curline, "elif after else"}
+			}
+			se, err := parseCondElement(tag[6:])
+			if err != nil {
+				return err
+			}
+			if err = p.checkFilters(se.expr); err != nil {
+				return err
+			}
+			current.elifs = append(current.elifs, &condBranch{expr: se.expr, pos: p.pos(tag)})
+			return nil
+		} else if tag == "?else" {
+			if current == nil || !current.isConditional {
+				return parseError{p.curline, "else outside of an if section"}
+			}
+			if current.hasElse {
+				return parseError{p.curline, "more than one else in an if section"}
+			}
 			current.hasElse = true
 			return nil
 		} else {
-			return parseError{tmpl.curline, "invalid conditional tag: " + tag}
+			return parseError{p.curline, "invalid conditional tag: " + tag}
 		}
-		/* FIXME: parse conditional into tokens */
-		// tokens, err := tokenize(tag[4:])
 
+	case '=':
+		return p.parseDelimiters(tag)
+	case '%':
+		return p.parseInheritanceTag(strings.TrimSpace(tag[1:]), section...)
+	case '>':
+		name := strings.TrimSpace(tag[1:])
+		partial, err := p.resolver.Resolve(name)
+		if err != nil {
+			return parseError{p.curline, fmt.Sprintf("partial %q: %s", name, err)}
+		}
+		*elems = append(*elems, partial)
 	case '/':
 		// if we aren't in a section, this is invalid
 		if len(section) == 0 {
-			return parseError{tmpl.curline, "unmatched close tag"}
+			return parseError{p.curline, "unmatched close tag"}
 		}
 
 		name := strings.TrimSpace(tag[1:])
 		if name != section[0].name {
-			return parseError{tmpl.curline, "interleaved closing tag: " + name}
+			return parseError{p.curline, "interleaved closing tag: " + name}
 		} else {
 			return endSection{}
 		}
 	case '{':
 		if tag[len(tag)-1] == '}' {
 			//use a raw tag
-			elem, _ := parseVarElement(tag[1 : len(tag)-1])
+			elem, err := parseVarElement(tag[1 : len(tag)-1])
+			if err != nil {
+				return parseError{p.curline, err.Error()}
+			}
+			if err = p.checkFilters(elem.expr); err != nil {
+				return err
+			}
 			elem.raw = true
+			elem.pos = p.pos(tag)
 			*elems = append(*elems, elem)
 		}
 	default:
-		elem, _ := parseVarElement(tag)
+		elem, err := parseVarElement(tag)
+		if err != nil {
+			return parseError{p.curline, err.Error()}
+		}
+		if err = p.checkFilters(elem.expr); err != nil {
+			return err
+		}
+		elem.pos = p.pos(tag)
 		*elems = append(*elems, elem)
 	}
 	return nil
 }
 
-func (tmpl *Template) parseSection(section *sectionElement) error {
+// Parse the name of an each section, like "each items" or "each items by
+// value", which iterates over the entries of maps.  The section is closed by
+// {{/each}}.
+func (p *parser) parseEach(se *sectionElement) error {
+	fields := strings.Fields(se.name)
+	se.name, se.each, se.order = "each", true, "key"
+	switch {
+	case len(fields) == 2:
+	case len(fields) == 4 && fields[2] == "by":
+		se.order = fields[3]
+	default:
+		return parseError{p.curline, "invalid each section: " + strings.Join(fields, " ")}
+	}
+	se.source = fields[1]
+	switch se.order {
+	case "key", "value", "natural":
+		return nil
+	}
+	return parseError{p.curline, "invalid order for each section: " + se.order}
+}
+
+// Parse the name of a with section, like "with total=items|len", which binds
+// names for the elements in the section.  The section is closed by {{/with}}.
+func (p *parser) parseWith(se *sectionElement) error {
+	bindings, err := parseBindings(se.name[len("with "):])
+	if err != nil {
+		return parseError{p.curline, err.Error()}
+	}
+	for _, b := range bindings {
+		if err = p.checkFilters(b.value); err != nil {
+			return err
+		}
+	}
+	se.name, se.bindings = "with", bindings
+	return nil
+}
+
+// Check the arity of the filters in expr against the template's environment.
+func (p *parser) checkFilters(expr interface{}) error {
+	if err := p.tmpl.env.checkFilters(expr); err != nil {
+		return parseError{p.curline, err.Error()}
+	}
+	return nil
+}
+
+// Parse a set delimiter tag like "=<% %>=", which changes the open and close
+// tags for the rest of the template.
+func (p *parser) parseDelimiters(tag string) error {
+	if len(tag) < 2 || tag[len(tag)-1] != '=' {
+		return parseError{p.curline, "invalid set delimiter tag: " + tag}
+	}
+	delims := strings.Fields(tag[1 : len(tag)-1])
+	if len(delims) != 2 || strings.Contains(delims[0], "=") || strings.Contains(delims[1], "=") {
+		return parseError{p.curline, "invalid set delimiter tag: " + tag}
+	}
+	p.otag, p.ctag = delims[0], delims[1]
+	return nil
+}
+
+func (p *parser) parseSection(section *sectionElement) error {
 	for {
-		text, err := tmpl.readString(tmpl.otag)
+		text, err := p.readString(p.otag)
 		if err == io.EOF {
-			return parseError{section.startline, "Section " + section.name + " has no closing tag"}
+			return parseError{section.pos.line, "Section " + section.name + " has no closing tag"}
 		}
 
 		// put text into an item
-		elems := &section.elems
-
-		if section.hasElse {
-			elems = &section.elseElems
-		}
+		elems := section.target()
 
-		text = text[0 : len(text)-len(tmpl.otag)]
+		text = text[0 : len(text)-len(p.otag)]
 		*elems = append(*elems, &textElement{[]byte(text)})
 
-		if tmpl.p < len(tmpl.data) && tmpl.data[tmpl.p] == '{' {
-			text, err = tmpl.readString("}" + tmpl.ctag)
+		if p.cur < len(p.data) && p.data[p.cur] == '{' {
+			text, err = p.readString("}" + p.ctag)
 		} else {
-			text, err = tmpl.readString(tmpl.ctag)
+			text, err = p.readString(p.ctag)
 		}
 
 		if err == io.EOF {
 			//put the remaining text in a block
-			return parseError{tmpl.curline, "unmatched open tag"}
+			return parseError{p.curline, "unmatched open tag"}
 		}
 
 		//trim the close tag off the text
-		tag := strings.TrimSpace(text[0 : len(text)-len(tmpl.ctag)])
-		err = tmpl.parseTag(tag, section)
+		tag := strings.TrimSpace(text[0 : len(text)-len(p.ctag)])
+		err = p.parseTag(tag, section)
 
 		/* if it was an endSection, end the section */
 		if _, ok := err.(endSection); ok {
@@ -295,42 +541,42 @@ func (tmpl *Template) parseSection(section *sectionElement) error {
 			return err
 		}
 	}
-	return nil
 }
 
-func (tmpl *Template) parse() error {
+func (p *parser) parse() error {
 	for {
-		text, err := tmpl.readString(tmpl.otag)
+		text, err := p.readString(p.otag)
 		if err == io.EOF {
 			//put the remaining text in a block
-			tmpl.elems = append(tmpl.elems, &textElement{[]byte(text)})
+			p.tmpl.elems = append(p.tmpl.elems, &textElement{[]byte(text)})
+			if len(p.extends) > 0 {
+				return p.inherit()
+			}
 			return nil
 		}
 
 		// put text into an item
-		text = text[0 : len(text)-len(tmpl.otag)]
-		tmpl.elems = append(tmpl.elems, &textElement{[]byte(text)})
+		text = text[0 : len(text)-len(p.otag)]
+		p.tmpl.elems = append(p.tmpl.elems, &textElement{[]byte(text)})
 
-		if tmpl.p < len(tmpl.data) && tmpl.data[tmpl.p] == '{' {
-			text, err = tmpl.readString("}" + tmpl.ctag)
+		if p.cur < len(p.data) && p.data[p.cur] == '{' {
+			text, err = p.readString("}" + p.ctag)
 		} else {
-			text, err = tmpl.readString(tmpl.ctag)
+			text, err = p.readString(p.ctag)
 		}
 
 		if err == io.EOF {
 			//put the remaining text in a block
-			return parseError{tmpl.curline, "unmatched open tag"}
+			return parseError{p.curline, "unmatched open tag"}
 		}
 
 		//trim the close tag off the text
-		tag := strings.TrimSpace(text[0 : len(text)-len(tmpl.ctag)])
-		err = tmpl.parseTag(tag)
+		tag := strings.TrimSpace(text[0 : len(text)-len(p.ctag)])
+		err = p.parseTag(tag)
 		if err != nil {
 			return err
 		}
 	}
-
-	return nil
 }
 
 // See if name is a method of the value at some level of indirection.
@@ -383,77 +629,184 @@ func call(v reflect.Value, method reflect.Method) reflect.Value {
 }
 
 // Evaluate interfaces and pointers looking for a value that can look up the name, via a
-// struct field, method, or map key, and return the result of the lookup.
-func lookup(contextChain []interface{}, name string) reflect.Value {
+// struct field, method, or map key, and return the result of the lookup.  If the name
+// is not found, the returned value is invalid.
+//
+// Names may be dotted paths like "user.address.city" or "items.0".  The first part
+// of the path is looked up through the context chain, and the rest is looked up in
+// the value it finds;  if a later part isn't found, neither is the name.  Paths can
+// also start with loop metadata, as in ".value.city".
+func lookup(contextChain []interface{}, name string) (ret reflect.Value, err error) {
 	defer func() {
 		if r := recover(); r != nil {
-			fmt.Printf("Panic while looking up %q: %s\n", name, r)
+			ret, err = reflect.Value{}, fmt.Errorf("panic while looking up %q: %v", name, r)
 		}
 	}()
 
-	var v reflect.Value
-	var index int
-	isList := false
+	// the first part keeps its leading dot, for loop metadata like .value.Name
+	path := name
+	for strings.HasPrefix(path, ".parent.") {
+		path = path[len(".parent"):]
+	}
+	i := -1
+	if len(path) > 1 {
+		i = strings.Index(path[1:], ".") + 1
+	}
+	if i <= 0 {
+		return lookupName(contextChain, name)
+	}
+	v, err := lookupName(contextChain, name[:len(name)-len(path)+i])
+	for _, part := range strings.Split(path[i+1:], ".") {
+		if err != nil || !v.IsValid() {
+			return reflect.Value{}, err
+		}
+		v, _, err = lookupIn(v, part)
+	}
+	return v, err
+}
 
-Outer:
-	for _, ctx := range contextChain { //i := len(contextChain) - 1; i >= 0; i-- {
-		if lc, ok := ctx.(*listContext); ok {
+// Look up a single name through the context chain, from the innermost context out.
+// Loop metadata like ".index" is that of the innermost list being iterated;  each
+// ".parent" prefix, as in ".parent.index", skips to the list enclosing it.
+func lookupName(contextChain []interface{}, name string) (reflect.Value, error) {
+	parents := 0
+	for strings.HasPrefix(name, ".parent.") {
+		parents++
+		name = name[len(".parent"):]
+	}
+	for _, ctx := range contextChain {
+		if cc, ok := ctx.(*captureContext); ok {
+			if cc.name == name {
+				return cc.value, nil
+			}
+			continue
+		}
+		lc, isList := ctx.(*listContext)
+		if parents > 0 {
+			// each .parent skips one enclosing list, whether or not it has
+			// the metadata
+			if isList {
+				parents--
+			}
+			continue
+		}
+		var v reflect.Value
+		if isList {
 			v = lc.context.(reflect.Value)
-			index = lc.index
-			isList = true
 		} else {
 			v = ctx.(reflect.Value)
 		}
-		for v.IsValid() {
-			typ := v.Type()
-			if n := v.Type().NumMethod(); n > 0 {
-				for i := 0; i < n; i++ {
-					m := typ.Method(i)
-					mtyp := m.Type
-					if m.Name == name && mtyp.NumIn() == 1 {
-						return v.Method(i).Call(nil)[0]
-					}
-				}
+		if name == "." {
+			return v, nil
+		}
+		if isList {
+			if meta, ok := lc.meta(name); ok {
+				return meta, nil
+			}
+		}
+		ret, found, err := lookupIn(v, name)
+		if err != nil || found {
+			return ret, err
+		}
+	}
+	return reflect.Value{}, nil
+}
+
+// Look up name in v, through pointers and interfaces, as a method, struct field,
+// map key, or slice or array index.  Map keys which aren't strings are parsed
+// from name.
+func lookupIn(v reflect.Value, name string) (ret reflect.Value, found bool, err error) {
+	for v.IsValid() {
+		if m := v.MethodByName(name); m.IsValid() && m.Type().NumIn() == 0 && m.Type().NumOut() > 0 {
+			ret, err = invokeMethod(m, name)
+			return ret, true, err
+		}
+
+		switch v.Kind() {
+		case reflect.Ptr, reflect.Interface:
+			v = v.Elem()
+		case reflect.Struct:
+			// unexported fields can't be used, so they are not found
+			ret = v.FieldByName(name)
+			if !ret.IsValid() || !ret.CanInterface() {
+				return reflect.Value{}, false, nil
 			}
-			if name == "." {
-				return v
+			return ret, true, nil
+		case reflect.Map:
+			key, ok := mapKey(name, v.Type().Key())
+			if !ok {
+				return reflect.Value{}, false, nil
 			}
-			if isList {
-				switch name {
-				case ".index":
-					return reflect.ValueOf(index)
-				case ".index1":
-					return reflect.ValueOf(index + 1)
-				}
+			ret = v.MapIndex(key)
+			return ret, ret.IsValid(), nil
+		case reflect.Slice, reflect.Array:
+			i, err := strconv.Atoi(name)
+			if err != nil || i < 0 || i >= v.Len() {
+				return reflect.Value{}, false, nil
 			}
+			return v.Index(i), true, nil
+		default:
+			return reflect.Value{}, false, nil
+		}
+	}
+	return reflect.Value{}, false, nil
+}
 
-			switch av := v; av.Kind() {
-			case reflect.Ptr:
-				v = av.Elem()
-			case reflect.Interface:
-				v = av.Elem()
-			case reflect.Struct:
-				ret := av.FieldByName(name)
-				if ret.IsValid() {
-					return ret
-				} else {
-					continue Outer
-				}
-			case reflect.Map:
-				ret := av.MapIndex(reflect.ValueOf(name))
-				if ret.IsValid() {
-					return ret
-				} else {
-					continue Outer
-				}
-			default:
-				continue Outer
-			}
+// Return name as a key for a map with keys of type t, parsing it if the keys
+// are numbers or bools.
+func mapKey(name string, t reflect.Type) (reflect.Value, bool) {
+	key := reflect.New(t).Elem()
+	switch t.Kind() {
+	case reflect.String:
+		key.SetString(name)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(name, 10, 64)
+		if err != nil || key.OverflowInt(i) {
+			return key, false
+		}
+		key.SetInt(i)
+	case reflect.Uint, reflect.Uintptr, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		u, err := strconv.ParseUint(name, 10, 64)
+		if err != nil || key.OverflowUint(u) {
+			return key, false
+		}
+		key.SetUint(u)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(name, 64)
+		if err != nil {
+			return key, false
+		}
+		key.SetFloat(f)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(name)
+		if err != nil {
+			return key, false
 		}
+		key.SetBool(b)
+	case reflect.Interface:
+		if !reflect.TypeOf(name).AssignableTo(t) {
+			return key, false
+		}
+		key.Set(reflect.ValueOf(name))
+	default:
+		return key, false
 	}
-	return reflect.Value{}
+	return key, true
 }
 
+// Call a method which takes no arguments.  Methods may return a value and an
+// error, in which case a non-nil error is returned with the method's name.
+func invokeMethod(method reflect.Value, name string) (reflect.Value, error) {
+	results := method.Call(nil)
+	if len(results) == 2 && results[1].Type() == errorType && !results[1].IsNil() {
+		return reflect.Value{}, fmt.Errorf("method %s: %w", name, results[1].Interface().(error))
+	}
+	return results[0], nil
+}
+
+// Return whether v is false in a section or conditional.  Besides nil, false
+// and empty strings, this is true for zero numbers and empty slices, arrays
+// and maps.
 func isNil(v reflect.Value) bool {
 	if !v.IsValid() || v.Interface() == nil {
 		return true
@@ -468,6 +821,16 @@ func isNil(v reflect.Value) bool {
 		return !val.Bool()
 	case reflect.String:
 		return len(val.String()) == 0
+	case reflect.Slice, reflect.Array, reflect.Map:
+		return val.Len() == 0
+	case reflect.Chan, reflect.Func:
+		return val.IsNil()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return val.Int() == 0
+	case reflect.Uint, reflect.Uintptr, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return val.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return val.Float() == 0
 	}
 
 	return false
@@ -488,103 +851,284 @@ loop:
 	return v
 }
 
-func renderSection(section *sectionElement, contextChain []interface{}, buf io.Writer) {
+// state holds the settings for a single render of a template.
+type state struct {
+	strict bool
+	env    *Env
+	// the context chain the template was executed with
+	root []interface{}
+}
+
+// Look up name in the context chain.  Since a - which follows a name is part
+// of it, a name like page-1 which is not found is the difference of page and
+// the number, if page is a number.  In strict mode, a name which is not found
+// is an error.
+func (s *state) lookup(contextChain []interface{}, name string) (reflect.Value, error) {
+	chain, path := s.scope(contextChain, name)
+	value, err := lookup(chain, path)
+	if err == nil && !value.IsValid() {
+		value, err = s.difference(contextChain, name)
+	}
+	if err == nil && !value.IsValid() && s.strict {
+		err = undefinedName(name)
+	}
+	return value, err
+}
+
+// Evaluate a name like page-1 as page - 1.  If the name isn't of that form or
+// page isn't a number, the returned value is invalid.
+func (s *state) difference(contextChain []interface{}, name string) (reflect.Value, error) {
+	i := strings.LastIndex(name, "-")
+	if i <= 0 {
+		return reflect.Value{}, nil
+	}
+	n, err := strconv.ParseUint(name[i+1:], 10, 64)
+	if err != nil {
+		return reflect.Value{}, nil
+	}
+	chain, path := s.scope(contextChain, name[:i])
+	value, err := lookup(chain, path)
+	if err != nil || !value.IsValid() || !isNumber(indirect(value).Kind()) {
+		return reflect.Value{}, err
+	}
+	diff, err := arith("-", value.Interface(), n)
+	return reflect.ValueOf(diff), err
+}
+
+// Resolve the scope of name.  Each leading "../" skips the innermost level of
+// the context chain, so a name shadowed in a section can be looked up in the
+// enclosing one, and "@root." looks the rest of the name up in the contexts
+// the template was executed with.  The chain and the rest of the name are
+// returned.
+func (s *state) scope(contextChain []interface{}, name string) ([]interface{}, string) {
+	if name == "@root" {
+		return s.root, "."
+	}
+	if strings.HasPrefix(name, "@root.") {
+		return s.root, name[len("@root."):]
+	}
+	for strings.HasPrefix(name, "../") || name == ".." {
+		for len(contextChain) > 0 {
+			if _, ok := contextChain[0].(*captureContext); !ok {
+				break
+			}
+			contextChain = contextChain[1:]
+		}
+		if len(contextChain) > 0 {
+			contextChain = contextChain[1:]
+		}
+		if name == ".." {
+			return contextChain, "."
+		}
+		name = name[len("../"):]
+	}
+	return contextChain, name
+}
+
+func (s *state) renderSection(section *sectionElement, contextChain []interface{}, buf io.Writer) error {
 	var value reflect.Value
 	var elems []interface{}
 
+	// blocks render in place, in the current context
+	if len(section.block) > 0 {
+		return s.renderElements(section.elems, contextChain, buf)
+	}
+
+	if section.bindings != nil {
+		return s.renderWith(section, contextChain, buf)
+	}
+
+	if section.inverted {
+		value, err := s.lookup(contextChain, section.name)
+		if err != nil {
+			return section.pos.wrap(err)
+		}
+		if !isNil(value) {
+			return nil
+		}
+		return s.renderElements(section.elems, contextChain, buf)
+	}
+
 	if !section.isConditional {
-		value = lookup(contextChain, section.name)
+		name := section.name
+		if section.each {
+			name = section.source
+		}
+		var err error
+		value, err = s.lookup(contextChain, name)
+		if err != nil {
+			return section.pos.wrap(err)
+		}
 		isNil := isNil(value)
 		if isNil {
-			return
+			return nil
 		}
 		elems = section.elems
 	} else {
-		if section.expr.Eval(contextChain) {
+		elems = section.elseElems
+		ok, err := evalCondition(s, section.expr, contextChain)
+		if err != nil {
+			return section.pos.wrap(err)
+		}
+		if ok {
 			elems = section.elems
 		} else {
-			elems = section.elseElems
+			for _, elif := range section.elifs {
+				ok, err = evalCondition(s, elif.expr, contextChain)
+				if err != nil {
+					return elif.pos.wrap(err)
+				}
+				if ok {
+					elems = elif.elems
+					break
+				}
+			}
 		}
+		return s.renderElements(elems, contextChain, buf)
+	}
+
+	if seq := sequence(value); seq != nil {
+		return s.renderSequence(seq, elems, contextChain, buf)
 	}
 
-	var context = contextChain[len(contextChain)-1].(reflect.Value)
 	var contexts = []interface{}{}
 
-	// if this is a real section, create a level in the context chain
-	if !section.isConditional {
-		valueInd := indirect(value)
-		switch val := valueInd; val.Kind() {
-		case reflect.Slice:
-			for i := 0; i < val.Len(); i++ {
-				contexts = append(contexts, &listContext{i, val.Index(i)})
-			}
-		case reflect.Array:
-			for i := 0; i < val.Len(); i++ {
-				contexts = append(contexts, &listContext{i, val.Index(i)})
-			}
-		case reflect.Map, reflect.Struct:
+	// this is a real section, so create a level in the context chain
+	valueInd := indirect(value)
+	switch val := valueInd; val.Kind() {
+	case reflect.Slice:
+		for i := 0; i < val.Len(); i++ {
+			contexts = append(contexts, &listContext{index: i, length: val.Len(), last: i == val.Len()-1, context: val.Index(i)})
+		}
+	case reflect.Array:
+		for i := 0; i < val.Len(); i++ {
+			contexts = append(contexts, &listContext{index: i, length: val.Len(), last: i == val.Len()-1, context: val.Index(i)})
+		}
+	case reflect.Map:
+		if section.each {
+			contexts = mapEntries(val, section.order)
+		} else {
 			contexts = append(contexts, value)
-		default:
-			contexts = append(contexts, context)
-		}
-		chain2 := make([]interface{}, len(contextChain)+1)
-		copy(chain2[1:], contextChain)
-		//by default we execute the section
-		for _, ctx := range contexts {
-			chain2[0] = ctx
-			for _, elem := range elems {
-				renderElement(elem, chain2, buf)
-			}
 		}
-	} else {
-		for _, elem := range elems {
-			renderElement(elem, contextChain, buf)
+	case reflect.Struct:
+		contexts = append(contexts, value)
+	default:
+		contexts = append(contexts, outermost(contextChain))
+	}
+	chain2 := make([]interface{}, len(contextChain)+1)
+	copy(chain2[1:], contextChain)
+	//by default we execute the section
+	for _, ctx := range contexts {
+		chain2[0] = ctx
+		if err := s.renderElements(elems, chain2, buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Return the outermost context in the chain, skipping captured names.
+func outermost(contextChain []interface{}) interface{} {
+	for i := len(contextChain) - 1; i >= 0; i-- {
+		if _, ok := contextChain[i].(*captureContext); !ok {
+			return contextChain[i]
+		}
+	}
+	return reflect.Value{}
+}
+
+// Render a with section.  Its bindings are evaluated once, in order, so each
+// can use the ones before it, and are pushed as a level of the context chain.
+func (s *state) renderWith(section *sectionElement, contextChain []interface{}, buf io.Writer) error {
+	scope := map[string]interface{}{}
+	chain := make([]interface{}, len(contextChain)+1)
+	copy(chain[1:], contextChain)
+	chain[0] = reflect.ValueOf(scope)
+	for _, b := range section.bindings {
+		val, err := evalOrNil(s, b.value, chain)
+		if err != nil {
+			return section.pos.wrap(err)
 		}
+		scope[b.name] = val
 	}
+	return s.renderElements(section.elems, chain, buf)
+}
 
+// Render elems in order.  The output of a capture section is not written to
+// buf, but is bound to its name for the rest of elems.
+func (s *state) renderElements(elems []interface{}, contextChain []interface{}, buf io.Writer) error {
+	for _, elem := range elems {
+		if se, ok := elem.(*sectionElement); ok && len(se.capture) > 0 {
+			var captured bytes.Buffer
+			if err := s.renderElements(se.elems, contextChain, &captured); err != nil {
+				return err
+			}
+			cc := &captureContext{se.capture, reflect.ValueOf(SafeString(captured.String()))}
+			contextChain = append([]interface{}{cc}, contextChain...)
+			continue
+		}
+		if err := s.renderElement(elem, contextChain, buf); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func renderElement(element interface{}, contextChain []interface{}, buf io.Writer) {
+func (s *state) renderElement(element interface{}, contextChain []interface{}, buf io.Writer) error {
 	switch elem := element.(type) {
 	case *textElement:
 		buf.Write(elem.text)
-	/* FIXME: have to probably do more here than lookup;  filters etc */
 	case *varElement:
-		defer func() {
-			if r := recover(); r != nil {
-				fmt.Printf("Panic while looking up %q: %s\n", elem, r)
-			}
-		}()
-
-		val, _ := elem.expr.Eval(contextChain)
+		val, err := elem.expr.Eval(s, contextChain)
+		if err != nil {
+			return elem.pos.wrap(err)
+		}
 		sval := fmt.Sprint(val)
-		if elem.raw {
+		if _, safe := val.(SafeString); elem.raw || safe {
 			fmt.Fprint(buf, sval)
 		} else {
 			htmlEscape(buf, []byte(sval))
 		}
 
 	case *sectionElement:
-		renderSection(elem, contextChain, buf)
+		return s.renderSection(elem, contextChain, buf)
 	case *Template:
-		elem.renderTemplate(contextChain, buf)
-	}
-}
-
-func (tmpl *Template) renderTemplate(contextChain []interface{}, buf io.Writer) {
-	for _, elem := range tmpl.elems {
-		renderElement(elem, contextChain, buf)
+		return s.renderElements(elem.elems, contextChain, buf)
 	}
+	return nil
 }
 
-func (tmpl *Template) Render(context ...interface{}) string {
-	var buf bytes.Buffer
+func (tmpl *Template) execute(s *state, w io.Writer, context []interface{}) error {
 	var contextChain []interface{}
 	for _, c := range context {
 		val := reflect.ValueOf(c)
 		contextChain = append(contextChain, val)
 	}
-	tmpl.renderTemplate(contextChain, &buf)
+	s.root = contextChain
+	return s.renderElements(tmpl.elems, contextChain, w)
+}
+
+// Execute renders the template with the given contexts to w.  If rendering
+// fails, the returned error is a *RenderError, and w may have been partially
+// written to.  If the template was parsed with Options.Strict, names which
+// aren't found and unknown filters are errors.  Filters are looked up in the
+// Env the template was parsed in.
+func (tmpl *Template) Execute(w io.Writer, context ...interface{}) error {
+	return tmpl.execute(&state{strict: tmpl.env.Strict, env: tmpl.env}, w, context)
+}
+
+// ExecuteStrict renders the template like Execute, but fails if a name is not
+// found in the context, a filter does not exist, or a filter can't be called
+// with the value and arguments it is given.
+func (tmpl *Template) ExecuteStrict(w io.Writer, context ...interface{}) error {
+	return tmpl.execute(&state{strict: true, env: tmpl.env}, w, context)
+}
+
+// Render the template with the given contexts and return the result.  Errors
+// are discarded;  use Execute to check for them.
+func (tmpl *Template) Render(context ...interface{}) string {
+	var buf bytes.Buffer
+	tmpl.Execute(&buf, context...)
 	return buf.String()
 }
 
@@ -596,34 +1140,71 @@ func (tmpl *Template) RenderInLayout(layout *Template, context ...interface{}) s
 	return layout.Render(allContext...)
 }
 
-func ParseString(data string) (*Template, error) {
-	cwd := os.Getenv("CWD")
-	tmpl := Template{data, "{{", "}}", 0, 1, cwd, []interface{}{}}
-	err := tmpl.parse()
+// Options control how a template is parsed.
+type Options struct {
+	// The delimiters in effect at the start of the template, which default
+	// to "{{" and "}}".  A template can change them with a set delimiter
+	// tag like {{=<% %>=}}.
+	Otag, Ctag string
+	// Resolver finds the templates named by partial and extends tags.  By
+	// default they are looked for on the filesystem.
+	Resolver Resolver
+	// Strict makes Execute fail on names which aren't found, unknown filters
+	// and filters which can't be called with their arguments.
+	Strict bool
+}
+
+// parse data into a template in env, finding partials with resolver
+func parseTemplate(name, data string, env *Env, resolver Resolver) (*Template, error) {
+	otag, ctag := env.Otag, env.Ctag
+	if len(otag) == 0 {
+		otag = "{{"
+	}
+	if len(ctag) == 0 {
+		ctag = "}}"
+	}
+	tmpl := &Template{name: name, env: env, elems: []interface{}{}}
+	p := parser{tmpl: tmpl, data: data, otag: otag, ctag: ctag, curline: 1, resolver: resolver}
+	err := p.parse()
 
 	if err != nil {
 		return nil, err
 	}
 
-	return &tmpl, err
+	return tmpl, nil
 }
 
-func ParseFile(filename string) (*Template, error) {
-	data, err := ioutil.ReadFile(filename)
-	if err != nil {
-		return nil, err
-	}
+func ParseString(data string) (*Template, error) {
+	return DefaultEnv.ParseString(data)
+}
+
+// Parse a template from a string using opts and the filters in DefaultEnv.
+func ParseStringOptions(data string, opts Options) (*Template, error) {
+	return DefaultEnv.withOptions(opts).ParseString(data)
+}
 
-	dirname, _ := path.Split(filename)
+func ParseFile(filename string) (*Template, error) {
+	return DefaultEnv.ParseFile(filename)
+}
 
-	tmpl := Template{string(data), "{{", "}}", 0, 1, dirname, []interface{}{}}
-	err = tmpl.parse()
+// Parse a template from a file using opts and the filters in DefaultEnv.
+func ParseFileOptions(filename string, opts Options) (*Template, error) {
+	return DefaultEnv.withOptions(opts).ParseFile(filename)
+}
 
+// parse a file which is being included by the files in parents
+func parseFile(filename string, env *Env, parents []string) (*Template, error) {
+	data, err := ioutil.ReadFile(filename)
 	if err != nil {
 		return nil, err
 	}
 
-	return &tmpl, nil
+	resolver := env.Resolver
+	if resolver == nil {
+		dirname, _ := path.Split(filename)
+		resolver = &fileResolver{dirname, parents, env}
+	}
+	return parseTemplate(filename, string(data), env, resolver)
 }
 
 func Render(data string, context ...interface{}) string {
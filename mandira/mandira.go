@@ -53,5 +53,5 @@ func main() {
 	var context interface{}
 	err = json.Unmarshal(contextdata, &context)
 	errExit(err)
-	fmt.Print(template.Render(context))
+	errExit(template.Execute(os.Stdout, context))
 }
@@ -1,6 +1,15 @@
 package mandira
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -20,6 +29,37 @@ func (t *Test) Run(tt *testing.T) {
 	}
 }
 
+// RunStrict parses the template in env and renders it in strict mode, which
+// must not fail.
+func (t *Test) RunStrict(tt *testing.T, env *Env) {
+	tmpl, err := env.ParseString(t.template)
+	if err != nil {
+		tt.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err = tmpl.ExecuteStrict(&buf, t.context); err != nil {
+		tt.Errorf("%q: unexpected error %v", t.template, err)
+	}
+	if buf.String() != t.expected {
+		tt.Errorf("%q: expected %q, got %q", t.template, t.expected, buf.String())
+	}
+}
+
+// Write files to a new temporary directory, and return the directory.
+func writeTemplates(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "mandira")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			os.RemoveAll(dir)
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
 type Data struct {
 	A bool
 	B string
@@ -60,6 +100,10 @@ func (u *User) Func6() ([]interface{}, error) {
 	return v, nil
 }
 
+func (u *User) Func7() (string, error) {
+	return "", errors.New("no func7 for " + u.Name)
+}
+
 func (u User) Truefunc1() bool {
 	return true
 }
@@ -153,6 +197,262 @@ func TestMustacheEquivalentBasics(t *testing.T) {
 	}
 }
 
+func TestInvertedSections(t *testing.T) {
+	tests := []Test{
+		{`{{^users}}none{{/users}}`, M{"users": []User{}}, "none"},
+		{`{{^users}}none{{/users}}`, M{"users": []User{{"Mike", 1}}}, ""},
+		{`{{^users}}none{{/users}}`, M{"users": (*User)(nil)}, "none"},
+		{`{{^users}}none{{/users}}`, M{}, "none"},
+		{`{{^users}}none{{/users}}`, M{"users": [0]int{}}, "none"},
+		{`{{^users}}none{{/users}}`, M{"users": map[string]int{}}, "none"},
+		{`{{^users}}none{{/users}}`, M{"users": map[string]int{"a": 1}}, ""},
+		{`{{^count}}zero{{/count}}`, M{"count": 0}, "zero"},
+		{`{{^count}}zero{{/count}}`, M{"count": uint8(0)}, "zero"},
+		{`{{^count}}zero{{/count}}`, M{"count": 0.0}, "zero"},
+		{`{{^count}}zero{{/count}}`, M{"count": 2}, ""},
+		{`{{^A}}{{B}}{{/A}}`, Data{false, "hello"}, "hello"},
+		{`{{^A}}{{B}}{{/A}}`, Data{true, "hello"}, ""},
+		{`{{#items}}{{.}}{{/items}}{{^items}}empty{{/items}}`, M{"items": []string{}}, "empty"},
+		{`{{#items}}{{.}}{{/items}}{{^items}}empty{{/items}}`, M{"items": []string{"a", "b"}}, "ab"},
+		{`{{?if count}}some{{?else}}none{{/if}}`, M{"count": 0}, "none"},
+	}
+	for _, test := range tests {
+		test.Run(t)
+	}
+}
+
+func TestSetDelimiters(t *testing.T) {
+	tests := []Test{
+		{`{{=<% %>=}}<% name %> {{name}}`, M{"name": "x"}, "x {{name}}"},
+		{`{{=<% %>=}}<%{name}%> <%name%>`, M{"name": "<b>"}, "<b> &lt;b&gt;"},
+		{`{{=<% %>=}}<%#list%><%.%>,<%/list%>`, M{"list": []int{1, 2}}, "1,2,"},
+		{`{{a}}{{= | | =}}|a||= {{ }} =|{{a}}`, M{"a": "a"}, "aaa"},
+		{`{{#list}}{{=[ ]=}}[.][/list]`, M{"list": []int{1, 2}}, "12"},
+		{`{{=<% %>}}`, M{}, "line 1: invalid set delimiter tag: =<% %>"},
+		{`{{=<%=}}`, M{}, "line 1: invalid set delimiter tag: =<%="},
+	}
+	for _, test := range tests {
+		test.Run(t)
+	}
+
+	opts := Options{Otag: `\VAR{`, Ctag: "}"}
+	tmpl, err := ParseStringOptions(`\\section{\VAR{title}} {{ not a tag }}`, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `\\section{Hi} {{ not a tag }}`
+	if out := tmpl.Render(M{"title": "Hi"}); out != expected {
+		t.Errorf("expected %q, got %q", expected, out)
+	}
+}
+
+func TestExecuteErrors(t *testing.T) {
+	env := NewEnv()
+	env.AddFilter(func(s string) string { panic("boom") }, "explode")
+	tests := []struct {
+		template string
+		context  interface{}
+		expected string
+		line     int
+		expr     string
+	}{
+		{"a\n{{name|explode}}", M{"name": "x"}, "a\n", 2, "name|explode"},
+		{"{{#list}}\n{{.}}\n{{?if 1 < .}}big{{/if}}{{/list}}", M{"list": []interface{}{1, "two"}}, "1\ntwo\n", 3, "?if 1 < ."},
+		{"{{?if a}}{{?elif 1 < b}}{{/if}}", M{"b": "x"}, "", 1, "?elif 1 < b"},
+	}
+	for _, test := range tests {
+		tmpl, err := env.ParseString(test.template)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		err = tmpl.Execute(&buf, test.context)
+		rerr, ok := err.(*RenderError)
+		if !ok {
+			t.Errorf("%q: expected a *RenderError, got %v", test.template, err)
+			continue
+		}
+		if rerr.Line != test.line || rerr.Expr != test.expr || rerr.Name != "" {
+			t.Errorf("%q: unexpected error position %v", test.template, rerr)
+		}
+		if buf.String() != test.expected {
+			t.Errorf("%q: expected output %q, got %q", test.template, test.expected, buf.String())
+		}
+	}
+
+	// missing names and filters are not errors
+	tmpl, _ := ParseString("{{nope}}{{name|nofilter}}{{name|join(nope)}}")
+	if err := tmpl.Execute(ioutil.Discard, M{"name": "x"}); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestUnexportedFields(t *testing.T) {
+	ctx := struct {
+		Name   string
+		secret string
+	}{"a", "b"}
+	tests := []Test{
+		{`{{Name}}{{secret}}`, ctx, "a"},
+		{`{{#secret}}x{{/secret}}`, ctx, ""},
+		{`{{^secret}}x{{/secret}}`, ctx, "x"},
+		{`{{?if secret == "b"}}x{{?else}}y{{/if}}`, ctx, "y"},
+		{`{{c.Name}}{{c.secret}}`, M{"c": &ctx}, "a"},
+	}
+	for _, test := range tests {
+		test.Run(t)
+	}
+
+	tmpl, _ := ParseString(`{{secret}}`)
+	if err := tmpl.ExecuteStrict(ioutil.Discard, ctx); err == nil || !strings.Contains(err.Error(), "secret") {
+		t.Errorf("expected an error naming secret, got %v", err)
+	}
+}
+
+func TestStrict(t *testing.T) {
+	ok := []Test{
+		{`{{name|upper}}`, M{"name": "bob"}, "BOB"},
+		{`{{#list}}{{.}}{{/list}}{{^empty}}none{{/empty}}`, M{"list": []int{1}, "empty": ""}, "1none"},
+		{`{{?if n > 1}}big{{/if}}`, M{"n": 2}, "big"},
+		{`{{names|join(sep)}}`, M{"names": []string{"a", "b"}, "sep": ","}, "a,b"},
+	}
+	for _, test := range ok {
+		test.RunStrict(t, DefaultEnv)
+	}
+
+	errs := []Test{
+		{`{{nope}}`, M{}, ""},
+		{`x{{name|nofilter}}`, M{"name": "bob"}, "x"},
+		{`{{name|upper}}`, M{"name": 1}, ""},
+		{`{{names|join(nope)}}`, M{"names": []string{"a"}}, ""},
+		{`{{#nope}}x{{/nope}}`, M{}, ""},
+		{`{{^nope}}x{{/nope}}`, M{}, ""},
+		{`{{?if nope}}x{{/if}}`, M{}, ""},
+		{`{{?if a}}{{?elif nope}}{{/if}}`, M{"a": false}, ""},
+	}
+	for _, test := range errs {
+		tmpl, err := ParseStringOptions(test.template, Options{Strict: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// these are not errors outside of strict mode
+		lenient, _ := ParseString(test.template)
+		if err = lenient.Execute(ioutil.Discard, test.context); err != nil {
+			t.Errorf("%q: unexpected error %v", test.template, err)
+		}
+		var buf bytes.Buffer
+		if err = tmpl.Execute(&buf, test.context); err == nil {
+			t.Errorf("%q: expected an error in strict mode", test.template)
+		} else if _, ok := err.(*RenderError); !ok {
+			t.Errorf("%q: expected a *RenderError, got %v", test.template, err)
+		}
+		if buf.String() != test.expected {
+			t.Errorf("%q: expected %q, got %q", test.template, test.expected, buf.String())
+		}
+	}
+}
+
+// Run with -race to check that templates can be rendered concurrently.
+func TestConcurrentRender(t *testing.T) {
+	tmpl, err := ParseString(`{{#users}}{{?if .index > 0}}, {{/if}}{{Name|upper}}{{/users}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "MIKE, MIKE, MIKE"
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				var buf bytes.Buffer
+				if err := tmpl.Execute(&buf, M{"users": makeVector(3)}); err != nil {
+					t.Error(err)
+				}
+				if buf.String() != expected {
+					t.Errorf("expected %q, got %q", expected, buf.String())
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestEnv(t *testing.T) {
+	a, b := NewEnv(), NewEnv()
+	a.AddFilter(func(s string) string { return "a:" + s }, "tag")
+	b.AddFilter(func(s string) string { return "b:" + s }, "tag")
+	b.Strict = true
+
+	ta, err := a.ParseString(`{{name|tag|upper}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tb, err := b.ParseString(`{{name|tag}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out := ta.Render(M{"name": "x"}); out != "A:X" {
+		t.Errorf("expected %q, got %q", "A:X", out)
+	}
+	if out := tb.Render(M{"name": "x"}); out != "b:x" {
+		t.Errorf("expected %q, got %q", "b:x", out)
+	}
+	// filters in an env are not visible elsewhere
+	if GetFilter("tag") != nil {
+		t.Errorf("expected tag filter to be missing from DefaultEnv")
+	}
+	if out := Render(`{{name|tag}}`, M{"name": "x"}); out != "" {
+		t.Errorf("expected an empty string, got %q", out)
+	}
+	if err := tb.Execute(ioutil.Discard, M{}); err == nil {
+		t.Errorf("expected strict env to fail on missing name")
+	}
+
+	loader := a.NewLoader("", false)
+	loader.Add("tagged", ta)
+	tmpl, err := loader.ParseString(`[{{>tagged}}{{name|tag}}]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out := tmpl.Render(M{"name": "x"}); out != "[A:Xa:x]" {
+		t.Errorf("expected %q, got %q", "[A:Xa:x]", out)
+	}
+}
+
+func TestFilterTypecheck(t *testing.T) {
+	env := NewEnv()
+	bad := []interface{}{
+		nil,
+		"upper",
+		func() string { return "" },
+		func(s string) {},
+		func(s string) (string, string) { return s, s },
+		func(s string) (string, error, error) { return s, nil, nil },
+	}
+	for _, filter := range bad {
+		if err := env.AddFilter(filter, "bad"); err == nil {
+			t.Errorf("expected an error adding filter %T", filter)
+		}
+	}
+	if env.GetFilter("bad") != nil {
+		t.Errorf("expected invalid filters not to be added")
+	}
+	if err := env.AddFilter(func(s string) (string, error) { return s, nil }, "ok"); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	for _, tpl := range []string{`{{x|join}}`, `{{{x|upper(1)}}}`, `{{?if x|index}}{{/if}}`, `{{?if a}}{{?elif x|len(1)}}{{/if}}`} {
+		if _, err := env.ParseString(tpl); err == nil {
+			t.Errorf("%q: expected a parse error", tpl)
+		}
+	}
+	// filters which aren't defined yet are checked when rendering
+	if _, err := env.ParseString(`{{x|later(1, 2)}}`); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
 func TestSample(t *testing.T) {
 	tests := []Test{
 		{`Hello {{name}}
@@ -213,6 +513,12 @@ func TestFilters(t *testing.T) {
 		{`{{names|len|divisibleby(3)}}`, M{"names": names}, "true"},
 		{`{{names|join(joiner)}}`, M{"names": names, "joiner": ", "}, "john, bob, fred"},
 		{`{{today|date("15:04")}}`, M{"today": today}, "12:01"},
+		{`{{names|index(i)}}`, M{"names": names, "i": 1}, "bob"},
+		{`{{names|index(i)}}`, M{"names": names, "i": uint8(2)}, "fred"},
+		{`{{names|join(sep|default(", "))}}`, M{"names": names}, "john, bob, fred"},
+		{`{{names|join(sep|upper)}}`, M{"names": names, "sep": "x"}, "johnXbobXfred"},
+		{`{{names|join(n)}}`, M{"names": names, "n": 0}, "john0bob0fred"},
+		{`{{name|index(names|len)}}`, M{"name": "jason", "names": names}, "o"},
 	}
 	for _, test := range tests {
 		test.Run(t)
@@ -242,6 +548,36 @@ func TestConditionals(t *testing.T) {
 	}
 }
 
+func TestElif(t *testing.T) {
+	tmpl := `{{?if n == 1}}one{{?elif n == 2}}two{{?elif n|len > 2}}many{{?else}}other{{/if}}`
+	tests := []Test{
+		{tmpl, M{"n": 1}, "one"},
+		{tmpl, M{"n": 2}, "two"},
+		{tmpl, M{"n": "three"}, "many"},
+		{tmpl, M{"n": 4}, "other"},
+		{`{{?if a}}a{{?elif b}}b{{/if}}`, M{"b": true}, "b"},
+		{`{{?if a}}a{{?elif b}}b{{/if}}`, M{}, ""},
+		{`{{?if a}}a{{?elif b}}{{?if c}}c{{?else}}b{{/if}}{{/if}}`, M{"b": true}, "b"},
+	}
+	for _, test := range tests {
+		test.Run(t)
+	}
+
+	errs := []string{
+		`{{?elif a}}`,
+		`{{?else}}`,
+		`{{#a}}{{?else}}{{/a}}`,
+		`{{?if a}}{{?else}}{{?elif b}}{{/if}}`,
+		`{{?if a}}{{?else}}{{?else}}{{/if}}`,
+		`{{?x}}`,
+	}
+	for _, e := range errs {
+		if _, err := ParseString(e); err == nil {
+			t.Errorf("expected parse error for %q", e)
+		}
+	}
+}
+
 func TestComplexConditionals(t *testing.T) {
 	tests := []Test{
 		{`{{?if (name)}}Hello{{/if}}`, M{"name": true}, "Hello"},
@@ -264,6 +600,96 @@ func TestComplexConditionals(t *testing.T) {
 	}
 }
 
+func TestOperatorPrecedence(t *testing.T) {
+	tests := []Test{
+		{`{{?if a or b and c}}yes{{?else}}no{{/if}}`, M{"a": true, "b": false, "c": false}, "yes"},
+		{`{{?if a and b or c}}yes{{?else}}no{{/if}}`, M{"a": false, "b": true, "c": true}, "yes"},
+		{`{{?if (a or b) and c}}yes{{?else}}no{{/if}}`, M{"a": true, "b": false, "c": false}, "no"},
+		{`{{?if not a and b}}yes{{?else}}no{{/if}}`, M{"a": false, "b": false}, "no"},
+		{`{{?if n > 1 or n < 0 and m}}yes{{?else}}no{{/if}}`, M{"n": 5, "m": false}, "yes"},
+		// "and" and "or" short-circuit, so the right hand side isn't evaluated
+		{`{{?if n and 10 / n > 2}}yes{{?else}}no{{/if}}`, M{"n": 0}, "no"},
+		{`{{?if not n or 10 / n > 2}}yes{{?else}}no{{/if}}`, M{"n": 0}, "yes"},
+	}
+	for _, test := range tests {
+		test.Run(t)
+	}
+
+	c := &counter{}
+	tmpl, _ := ParseString(`{{?if n or c.Expensive}}{{/if}}{{?if not n and c.Expensive}}{{/if}}`)
+	if err := tmpl.Execute(ioutil.Discard, M{"n": 1, "c": c}); err != nil {
+		t.Fatal(err)
+	}
+	if c.calls != 0 {
+		t.Errorf("expected the right hand side not to be evaluated, got %d calls", c.calls)
+	}
+}
+
+func TestComparisons(t *testing.T) {
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	ctx := M{
+		"price": 10.5, "n": float64(3), "i": 3, "u": uint8(3), "big": uint64(1 << 63), "neg": int64(-1),
+		"yes": true, "no": false, "none": nil, "ptr": (*person)(nil), "name": SafeString("bob"),
+		"now": now, "later": now.Add(time.Hour), "at": &now,
+	}
+	tests := []Test{
+		{`{{?if price > 9.99}}yes{{?else}}no{{/if}}`, ctx, "yes"},
+		{`{{?if price < 10}}yes{{?else}}no{{/if}}`, ctx, "no"},
+		{`{{?if n > 2}}yes{{?else}}no{{/if}}`, ctx, "yes"},
+		{`{{?if n == i and i == u and u == 3.0}}yes{{?else}}no{{/if}}`, ctx, "yes"},
+		{`{{?if u >= 3 and u <= i}}yes{{?else}}no{{/if}}`, ctx, "yes"},
+		{`{{?if big > neg and neg < u}}yes{{?else}}no{{/if}}`, ctx, "yes"},
+		{`{{?if yes == yes and yes != no}}yes{{?else}}no{{/if}}`, ctx, "yes"},
+		{`{{?if none == ptr and none != i}}yes{{?else}}no{{/if}}`, ctx, "yes"},
+		{`{{?if name == "bob" and name < "carl"}}yes{{?else}}no{{/if}}`, ctx, "yes"},
+		{`{{?if now < later and later >= now and at == now}}yes{{?else}}no{{/if}}`, ctx, "yes"},
+		{`{{?if i == "3"}}yes{{?else}}no{{/if}}`, ctx, "no"},
+		{`{{?if i != "3"}}yes{{?else}}no{{/if}}`, ctx, "yes"},
+		{`{{?if yes == true and no == false and no != true}}yes{{?else}}no{{/if}}`, ctx, "yes"},
+		{`{{?if ptr == nil and none == nil and i != nil and nil == nil}}yes{{?else}}no{{/if}}`, ctx, "yes"},
+		{`{{?if yes == 1}}yes{{?else}}no{{/if}}`, ctx, "no"},
+		{`{{?if name|upper == "BOB"}}yes{{?else}}no{{/if}}`, ctx, "yes"},
+		// in comparisons, true, false and nil are literals unless they are names
+		{`{{?if x == true}}yes{{?else}}no{{/if}}`, M{"x": 1, "true": 1}, "yes"},
+		{`{{?if nil != nil}}yes{{?else}}no{{/if}}`, M{"nil": 0}, "no"},
+		// missing names are nil, and nil isn't ordered outside of strict mode
+		{`{{?if missing == nil and missing != ""}}yes{{?else}}no{{/if}}`, ctx, "yes"},
+		{`{{?if count > 0}}yes{{?else}}no{{/if}}`, ctx, "no"},
+		{`{{?if count <= 0 or none >= 0 or 0 < nil}}yes{{?else}}no{{/if}}`, ctx, "no"},
+		{`{{?if count + 1 > 0}}yes{{?else}}no{{/if}}`, ctx, "no"},
+	}
+	for _, test := range tests {
+		test.Run(t)
+	}
+
+	errs := []string{
+		`{{?if i < "3"}}{{/if}}`,
+		`{{?if yes > no}}{{/if}}`,
+		`{{?if yes < true}}{{/if}}`,
+		`{{?if now > 1}}{{/if}}`,
+	}
+	for _, e := range errs {
+		tmpl, err := ParseString(e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = tmpl.Execute(ioutil.Discard, ctx); err == nil || !strings.Contains(err.Error(), "cannot compare") {
+			t.Errorf("%q: expected a comparison error, got %v", e, err)
+		}
+	}
+
+	// in strict mode, missing names and ordering nil are errors
+	for _, e := range []string{`{{?if count > 0}}{{/if}}`, `{{?if missing == nil}}{{/if}}`, `{{?if none < 1}}{{/if}}`} {
+		tmpl, err := ParseString(e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = tmpl.ExecuteStrict(ioutil.Discard, ctx); err == nil {
+			t.Errorf("%q: expected an error in strict mode", e)
+		}
+	}
+}
+
 func TestContextSensitiveVariables(t *testing.T) {
 	tests := []Test{
 		{`{{.index}}`, M{".index": "hi"}, "hi"},
@@ -276,3 +702,586 @@ func TestContextSensitiveVariables(t *testing.T) {
 		test.Run(t)
 	}
 }
+
+func TestPartials(t *testing.T) {
+	dir := writeTemplates(t, map[string]string{
+		"header.mustache": `<h1>{{title}}</h1>`,
+		"item.mustache":   `<li>{{name}}</li>`,
+		"page":            `{{>header}}<ul>{{#items}}{{> item}}{{/items}}</ul>{{?if footer}}{{>header}}{{/if}}`,
+		"a.mustache":      `a{{>b}}`,
+		"b.mustache":      `b{{>a}}`,
+		"self.mustache":   `{{>self}}`,
+		"missing":         `{{>nope}}`,
+	})
+	defer os.RemoveAll(dir)
+
+	tmpl, err := ParseFile(filepath.Join(dir, "page"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := M{"title": "Hi", "footer": true, "items": []M{{"name": "a"}, {"name": "b"}}}
+	expected := `<h1>Hi</h1><ul><li>a</li><li>b</li></ul><h1>Hi</h1>`
+	if out := tmpl.Render(ctx); out != expected {
+		t.Errorf("expected %q, got %q", expected, out)
+	}
+
+	for _, name := range []string{"a.mustache", "self.mustache", "missing"} {
+		if _, err := ParseFile(filepath.Join(dir, name)); err == nil {
+			t.Errorf("expected parse error for %s", name)
+		}
+	}
+}
+
+func TestFilterErrors(t *testing.T) {
+	env := NewEnv()
+	env.AddFilter(func(s string) (int, error) { return strconv.Atoi(s) }, "atoi")
+
+	tests := []Test{
+		{`{{n|atoi}}`, M{"n": "12"}, "12"},
+		{`{{n|atoi|default("none")}}`, M{"n": "x"}, "none"},
+		{`{{n|atoi|upper|default(0)}}`, M{"n": "x"}, "0"},
+		{`{{n|default("none")}}`, M{"n": ""}, "none"},
+		{`{{nope|default("none")}}`, M{}, "none"},
+		{`{{nope|default(n)|atoi}}`, M{"n": "3"}, "3"},
+		{`{{?if n|atoi|default(0)}}yes{{?else}}no{{/if}}`, M{"n": "x"}, "no"},
+	}
+	for _, test := range tests {
+		test.RunStrict(t, env)
+	}
+
+	for _, tpl := range []string{"{{n|atoi}}", "{{n|atoi|upper}}", "{{?if n|atoi}}{{/if}}"} {
+		tmpl, err := env.ParseString("\n" + tpl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = tmpl.Execute(ioutil.Discard, M{"n": "x"})
+		re, ok := err.(*RenderError)
+		if !ok {
+			t.Errorf("%q: expected a *RenderError, got %v", tpl, err)
+			continue
+		}
+		if re.Line != 2 {
+			t.Errorf("%q: expected error on line 2, got %d", tpl, re.Line)
+		}
+		var fe *FilterError
+		if !errors.As(err, &fe) || fe.Filter != "atoi" {
+			t.Errorf("%q: expected a *FilterError for atoi, got %v", tpl, err)
+		}
+	}
+}
+
+func TestMethodErrors(t *testing.T) {
+	user := &User{"Mike", 1}
+	for _, tpl := range []string{"{{Func7}}", "{{Func7|upper}}", "{{#Func7}}x{{/Func7}}", "{{^Func7}}x{{/Func7}}", "{{?if Func7}}x{{/if}}"} {
+		tmpl, err := ParseString(tpl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = tmpl.Execute(ioutil.Discard, user)
+		if err == nil {
+			t.Errorf("%q: expected an error", tpl)
+		} else if _, ok := err.(*RenderError); !ok || !strings.Contains(err.Error(), "Func7") {
+			t.Errorf("%q: expected a *RenderError naming Func7, got %v", tpl, err)
+		}
+	}
+
+	tests := []Test{
+		{`{{Func7|default("none")}}`, user, "none"},
+		{`{{#Func3}}{{name}}{{/Func3}}`, user, "Mike"},
+	}
+	for _, test := range tests {
+		test.RunStrict(t, DefaultEnv)
+	}
+}
+
+func TestFilterArgumentTypes(t *testing.T) {
+	env := NewEnv()
+	env.AddFilter(func(x float64, y float64) float64 { return x * y }, "mul")
+	env.AddFilter(func(s string, b bool) string {
+		if b {
+			return strings.ToUpper(s)
+		}
+		return s
+	}, "upperif")
+	env.AddFilter(func(s string, names []string) bool {
+		for _, n := range names {
+			if n == s {
+				return true
+			}
+		}
+		return false
+	}, "in")
+	env.AddFilter(func(s string, v interface{}) string { return fmt.Sprintf("%s=%#v", s, v) }, "show")
+
+	tests := []Test{
+		{`{{n|mul(f)}}`, M{"n": 2, "f": 1.5}, "3"},
+		{`{{n|mul(f|mul(2))}}`, M{"n": 2, "f": 1.5}, "6"},
+		{`{{s|upperif(b)}}`, M{"s": "x", "b": true}, "X"},
+		{`{{s|upperif(b)}}`, M{"s": "x", "b": false}, "x"},
+		{`{{s|in(names)}}`, M{"s": "bob", "names": []string{"al", "bob"}}, "true"},
+		{`{{{s|show(v)}}}`, M{"s": "v", "v": []int{1}}, "v=[]int{1}"},
+		{`{{{s|show(v|len)}}}`, M{"s": "v", "v": []int{1}}, "v=1"},
+	}
+	for _, test := range tests {
+		test.RunStrict(t, env)
+	}
+
+	// nested filters are type checked when parsing
+	if _, err := env.ParseString(`{{n|mul(f|mul)}}`); err == nil {
+		t.Errorf("expected a parse error")
+	}
+}
+
+type moneyOptions struct {
+	Currency string
+	Places   int
+}
+
+func TestFilterKeywords(t *testing.T) {
+	env := NewEnv()
+	env.AddFilter(func(v interface{}, alts ...interface{}) interface{} {
+		for _, a := range append([]interface{}{v}, alts...) {
+			if a != nil && a != "" {
+				return a
+			}
+		}
+		return nil
+	}, "coalesce")
+	env.AddFilter(func(s string, sep string, rest ...string) string {
+		return strings.Join(append([]string{s}, rest...), sep)
+	}, "concat")
+	env.AddFilter(func(v float64, opts moneyOptions) string {
+		if opts.Currency == "" {
+			opts.Currency = "USD"
+		}
+		return fmt.Sprintf("%.*f %s", opts.Places, v, opts.Currency)
+	}, "money")
+	env.AddFilter(func(v float64, sym string, opts *moneyOptions) string {
+		return fmt.Sprintf("%s%.*f", sym, opts.Places, v)
+	}, "price")
+	env.AddFilter(func(s string, attrs map[string]string) string {
+		return fmt.Sprintf("<%s id=%s class=%s>", s, attrs["id"], attrs["class"])
+	}, "tag")
+
+	tests := []Test{
+		{`{{a|coalesce(b, c)}}`, M{"a": "", "b": nil, "c": "C"}, "C"},
+		{`{{a|coalesce(b, c)}}`, M{"a": "A", "b": nil, "c": "C"}, "A"},
+		{`{{a|coalesce}}`, M{"a": "A"}, "A"},
+		{`{{a|coalesce(nope|default(""), "x")}}`, M{"a": ""}, "x"},
+		{`{{a|concat("-")}}`, M{"a": "x"}, "x"},
+		{`{{a|concat("-", b, 1)}}`, M{"a": "x", "b": "y"}, "x-y-1"},
+		{`{{p|money}}`, M{"p": 2}, "2 USD"},
+		{`{{p|money(currency="EUR", places=2)}}`, M{"p": 2.5}, "2.50 EUR"},
+		{`{{p|money(Places=n|len)}}`, M{"p": 2.5, "n": "abc"}, "2.500 USD"},
+		{`{{p|price("$", places=1)}}`, M{"p": 2.25}, "$2.2"},
+		{`{{{s|tag(id=id, class="big")}}}`, M{"s": "div", "id": 7}, "<div id=7 class=big>"},
+	}
+	for _, test := range tests {
+		test.RunStrict(t, env)
+	}
+
+	parseErrs := []string{
+		`{{a|concat}}`,
+		`{{a|coalesce(x=1)}}`,
+		`{{a|upper(x=1)}}`,
+		`{{p|price(places=1)}}`,
+	}
+	for _, tpl := range parseErrs {
+		if _, err := env.ParseString(tpl); err == nil {
+			t.Errorf("%q: expected a parse error", tpl)
+		}
+	}
+
+	tmpl, err := env.ParseString(`{{p|money(cents=2)}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = tmpl.ExecuteStrict(ioutil.Discard, M{"p": 1}); err == nil || !strings.Contains(err.Error(), "cents") {
+		t.Errorf("expected an error for an unknown option, got %v", err)
+	}
+	if err := env.AddFilter(func(v ...string) string { return "" }, "bad"); err == nil {
+		t.Errorf("expected an error adding a filter with only a variadic parameter")
+	}
+}
+
+type address struct {
+	City string
+}
+
+type person struct {
+	Name    string
+	Address *address
+	Tags    []string
+}
+
+func (p person) Upper() string { return strings.ToUpper(p.Name) }
+
+func TestDottedLookups(t *testing.T) {
+	bob := person{"bob", &address{"Paris"}, []string{"a", "b"}}
+	tests := []Test{
+		{`{{user.Address.City}}`, M{"user": bob}, "Paris"},
+		{`{{user.Address.City}}`, M{"user": &bob}, "Paris"},
+		{`{{user.Upper}}`, M{"user": bob}, "BOB"},
+		{`{{user.Tags.1}}`, M{"user": bob}, "b"},
+		{`{{user.Tags.2}}`, M{"user": bob}, ""},
+		{`{{items.0.title|upper}}`, M{"items": []M{{"title": "first"}}}, "FIRST"},
+		{`{{a.b.c}}`, M{"a": M{"b": map[string]int{"c": 3}}}, "3"},
+		{`{{m.2}}`, M{"m": map[int]string{2: "two"}}, "two"},
+		{`{{m.true}}`, M{"m": map[bool]string{true: "yes"}}, "yes"},
+		{`{{m.x}}`, M{"m": map[int]string{2: "two"}}, ""},
+		{`{{arr.1}}`, M{"arr": [2]int{5, 6}}, "6"},
+		{`{{#user.Address}}{{City}}{{/user.Address}}`, M{"user": bob}, "Paris"},
+		{`{{#user.Tags}}{{.}}{{/user.Tags}}`, M{"user": bob}, "ab"},
+		{`{{?if user.Address.City == "Paris"}}yes{{/if}}`, M{"user": bob}, "yes"},
+		{`{{?if not user.Phone}}none{{/if}}`, M{"user": bob}, "none"},
+		{`{{user.Tags|join(sep.value)}}`, M{"user": bob, "sep": M{"value": "+"}}, "a+b"},
+		// the first part is found in the innermost context which has it, and
+		// the rest is not looked up further out
+		{`{{#inner}}{{a.b}}{{/inner}}`, M{"a": M{"b": "outer"}, "inner": M{"a": M{"c": 1}}}, ""},
+		{`{{#inner}}{{a.b}}{{/inner}}`, M{"a": M{"b": "outer"}, "inner": M{"x": 1}}, "outer"},
+	}
+	for _, test := range tests {
+		test.Run(t)
+	}
+
+	tmpl, err := ParseString(`{{user.Address.Street}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = tmpl.ExecuteStrict(ioutil.Discard, M{"user": bob}); err == nil || !strings.Contains(err.Error(), "user.Address.Street") {
+		t.Errorf("expected an error naming user.Address.Street, got %v", err)
+	}
+}
+
+func TestScopeLookups(t *testing.T) {
+	ctx := M{
+		"name": "root",
+		"id":   0,
+		"groups": []M{
+			{"name": "g1", "items": []M{{"name": "a"}, {"name": "b"}}},
+		},
+		"site": M{"title": "Site"},
+	}
+	tests := []Test{
+		{`{{#groups}}{{name}}/{{../name}}{{/groups}}`, ctx, "g1/root"},
+		{`{{#groups}}{{#items}}{{name}}<{{../name}}<{{../../name}} {{/items}}{{/groups}}`, ctx, "a<g1<root b<g1<root "},
+		{`{{#groups}}{{#items}}{{@root.name}}{{/items}}{{/groups}}`, ctx, "rootroot"},
+		{`{{#groups}}{{#items}}{{@root.site.title|upper}}{{/items}}{{/groups}}`, ctx, "SITESITE"},
+		{`{{#groups}}{{#items}}{{../.index1}}.{{.index1}} {{/items}}{{/groups}}`, ctx, "1.1 1.2 "},
+		{`{{#groups}}{{?if ../id == 0}}zero{{/if}}{{/groups}}`, ctx, "zero"},
+		{`{{#groups}}{{#items}}{{?if name != ../name}}{{name|format(../name)}}{{/if}}{{/items}}{{/groups}}`, M{"groups": []M{{"name": "%s!", "items": []M{{"name": "a"}}}}}, "a!"},
+		{`{{#site}}{{#@root.groups}}{{name}}{{/@root.groups}}{{/site}}`, ctx, "g1"},
+		// ../ walks outward from the enclosing scope
+		{`{{#groups}}{{#items}}{{../id}}{{/items}}{{/groups}}`, ctx, "00"},
+		{`{{../../../name}}`, ctx, ""},
+	}
+	for _, test := range tests {
+		test.Run(t)
+	}
+}
+
+func TestLoopMetadata(t *testing.T) {
+	names := []string{"a", "b", "c"}
+	tests := []Test{
+		{`{{#names}}{{.}}{{?if not .last}}, {{/if}}{{/names}}`, M{"names": names}, "a, b, c"},
+		{`{{#names}}{{?if .first}}[{{/if}}{{.}}{{/names}}`, M{"names": names}, "[abc"},
+		{`{{#names}}{{.index}}{{.index1}}{{.revindex}}{{.revindex1}}{{.length}} {{/names}}`, M{"names": names}, "01233 12123 23013 "},
+		{`{{#names}}{{?if .odd}}o{{/if}}{{?if .even}}e{{/if}}{{/names}}`, M{"names": names}, "oeo"},
+		{`{{#arr}}{{.last}}{{/arr}}`, M{"arr": [2]int{1, 2}}, "falsetrue"},
+		{`{{#rows}}{{#cols}}{{.parent.index}}{{.index}}{{?if .parent.last and .last}}!{{/if}} {{/cols}}{{/rows}}`,
+			M{"rows": []M{{"cols": []int{1, 2}}, {"cols": []int{1}}}}, "00 01 10! "},
+		{`{{#rows}}{{#cols}}{{.parent.parent.index}}{{/cols}}{{/rows}}`, M{"rows": []M{{"cols": []int{1}}}}, ""},
+		// each .parent skips one loop, even one without the metadata
+		{`{{#each m}}{{#.value}}{{.parent.key}}{{.index}} {{/.value}}{{/each}}`, M{"m": map[string][]int{"a": {1, 2}}}, "a0 a1 "},
+		// metadata is still found inside sections nested in a loop
+		{`{{#names}}{{#x}}{{.index}}{{/x}}{{/names}}`, M{"names": names, "x": M{"y": 1}}, "012"},
+	}
+	for _, test := range tests {
+		test.Run(t)
+	}
+}
+
+func TestEach(t *testing.T) {
+	scores := map[string]int{"carol": 2, "alice": 3, "bob": 1}
+	tests := []Test{
+		{`{{#each scores}}{{.key}}={{.value}} {{/each}}`, M{"scores": scores}, "alice=3 bob=1 carol=2 "},
+		{`{{#each scores by key}}{{.key}}{{/each}}`, M{"scores": scores}, "alicebobcarol"},
+		{`{{#each scores by value}}{{.key}}{{/each}}`, M{"scores": scores}, "bobcarolalice"},
+		{`{{#each m by value}}{{.key}}{{/each}}`, M{"m": map[string]int{"b": 1, "a": 1, "c": 0}}, "cab"},
+		{`{{#each m}}{{.key}}{{/each}}`, M{"m": map[string]int{"item10": 1, "item2": 1, "item1": 1}}, "item1item10item2"},
+		{`{{#each m by natural}}{{.key}} {{/each}}`, M{"m": map[string]int{"item10": 1, "item2": 1, "item1": 1, "item02": 1}}, "item1 item02 item2 item10 "},
+		{`{{#each m}}{{.key}}{{/each}}`, M{"m": map[int]string{10: "a", 2: "b", -1: "c"}}, "-1210"},
+		{`{{#each m}}{{.}}{{/each}}`, M{"m": map[float64]string{1.5: "b", 0.5: "a"}}, "ab"},
+		{`{{#each m}}{{.index}}{{?if not .last}},{{/if}}{{/each}}`, M{"m": scores}, "0,1,2"},
+		{`{{#each users}}{{.key}}:{{Name}}{{?if .value.Id > 1}}+{{/if}} {{/each}}`, M{"users": map[string]*User{"b": {"Bob", 2}, "a": {"Al", 1}}}, "a:Al b:Bob+ "},
+		{`{{#each m}}{{#each .value}}{{../.key}}{{.key}}{{/each}}{{/each}}`, M{"m": M{"x": M{"b": 1, "a": 2}, "y": M{"c": 3}}}, "xaxbyc"},
+		{`{{#each empty}}x{{/each}}`, M{"empty": M{}}, ""},
+		// each over a list is a normal section
+		{`{{#each names}}{{.}}{{/each}}`, M{"names": []string{"a", "b"}}, "ab"},
+		// without each, a map is a single context
+		{`{{#m}}{{a}}{{/m}}`, M{"m": M{"a": 1}}, "1"},
+	}
+	for _, test := range tests {
+		test.Run(t)
+	}
+
+	// the order is the same every time
+	tmpl, _ := ParseString(`{{#each m}}{{.key}}{{/each}}`)
+	m := M{}
+	for i := 0; i < 50; i++ {
+		m[strconv.Itoa(i)] = i
+	}
+	first := tmpl.Render(M{"m": m})
+	for i := 0; i < 10; i++ {
+		if out := tmpl.Render(M{"m": m}); out != first {
+			t.Fatalf("expected %q, got %q", first, out)
+		}
+	}
+
+	for _, tpl := range []string{`{{#each m by size}}{{/each}}`, `{{#each m x}}{{/each}}`, `{{#each m}}{{/m}}`} {
+		if _, err := ParseString(tpl); err == nil {
+			t.Errorf("%q: expected a parse error", tpl)
+		}
+	}
+}
+
+type countdown int
+
+func (c *countdown) Next() (interface{}, bool) {
+	if *c <= 0 {
+		return nil, false
+	}
+	*c--
+	return int(*c) + 1, true
+}
+
+func TestSequences(t *testing.T) {
+	ch := func(items ...string) <-chan string {
+		c := make(chan string, len(items))
+		for _, item := range items {
+			c <- item
+		}
+		close(c)
+		return c
+	}
+	seq := func(yield func(string) bool) {
+		for _, s := range []string{"x", "y", "z"} {
+			if !yield(s) {
+				return
+			}
+		}
+	}
+	seq2 := func(yield func(string, int) bool) {
+		_ = yield("a", 1) && yield("b", 2)
+	}
+	three := countdown(3)
+
+	tests := []Test{
+		{`{{#c}}{{.}}{{?if not .last}},{{/if}}{{/c}}`, M{"c": ch("a", "b", "c")}, "a,b,c"},
+		{`{{#c}}{{.index1}}{{.first}}{{/c}}`, M{"c": ch("a", "b")}, "1true2false"},
+		{`{{#c}}x{{/c}}`, M{"c": ch()}, ""},
+		{`{{#c}}x{{/c}}`, M{"c": (chan int)(nil)}, ""},
+		{`{{#seq}}{{.|upper}}{{.odd}} {{/seq}}`, M{"seq": seq}, "Xtrue Yfalse Ztrue "},
+		{`{{#seq}}{{.length}}{{.revindex}}{{/seq}}`, M{"seq": seq}, ""},
+		{`{{#seq2}}{{.key}}={{.value}}{{?if .last}}.{{/if}} {{/seq2}}`, M{"seq2": seq2}, "a=1 b=2. "},
+		{`{{#it}}{{.}}{{/it}}`, M{"it": &three}, "321"},
+		{`{{#rows}}{{#cols}}{{.parent.index}}{{.}}{{/cols}}{{/rows}}`, M{"rows": []M{{"cols": ch("a")}, {"cols": ch("b")}}}, "0a1b"},
+		{`{{#rows}}{{#cols}}{{.parent.length}}{{.}}{{/cols}}{{/rows}}`, M{"rows": []M{{"cols": ch("a")}, {"cols": ch("b")}}}, "2a2b"},
+	}
+	for _, test := range tests {
+		test.Run(t)
+	}
+
+	// a channel is read as it is rendered
+	c := make(chan int)
+	go func() {
+		for i := 0; i < 100; i++ {
+			c <- i
+		}
+		close(c)
+	}()
+	out := Render(`{{#c}}{{?if .last}}{{.}}{{/if}}{{/c}}`, M{"c": c})
+	if out != "99" {
+		t.Errorf("expected %q, got %q", "99", out)
+	}
+
+	// rendering stops at the first error
+	n := 0
+	counting := func(yield func(int) bool) {
+		for n = 0; n < 10; n++ {
+			if !yield(n) {
+				return
+			}
+		}
+	}
+	tmpl, _ := ParseString(`{{#seq}}{{?if . > 1}}{{nope}}{{/if}}{{/seq}}`)
+	if err := tmpl.ExecuteStrict(ioutil.Discard, M{"seq": counting}); err == nil {
+		t.Errorf("expected an error")
+	}
+	if n > 4 {
+		t.Errorf("expected iteration to stop after the error, got to %d", n)
+	}
+}
+
+type counter struct {
+	calls int
+}
+
+func (c *counter) Expensive() int {
+	c.calls++
+	return 42
+}
+
+func TestWith(t *testing.T) {
+	items := []string{"a", "b", "c"}
+	tests := []Test{
+		{`{{#with total=items|len}}{{total}} {{?if total > 2}}many{{/if}}{{/with}}`, M{"items": items}, "3 many"},
+		{`{{#with total=items|len, sep=", "}}{{items|join(sep)}} ({{total}}){{/with}}`, M{"items": items}, "a, b, c (3)"},
+		{`{{#with n=items|len, half=n|divisibleby(2)}}{{half}}{{/with}}`, M{"items": items}, "false"},
+		{`{{#with name=name|upper}}{{name}}/{{../name}}{{/with}}`, M{"name": "bob"}, "BOB/bob"},
+		{`{{#with first=items.0}}{{#items}}{{first}}{{.}}{{/items}}{{/with}}`, M{"items": items}, "aaabac"},
+		{`{{#with x=1}}{{#with x=2}}{{x}}{{../x}}{{/with}}{{x}}{{/with}}{{x}}`, M{}, "211"},
+		{`{{#with u=user}}{{u.Name}}{{/with}}`, M{"user": &User{"Mike", 1}}, "Mike"},
+		{`{{#with missing=nope}}[{{missing}}]{{/with}}`, M{}, "[]"},
+		// missing names and nil values are bound as nil, like they are compared
+		{`{{#with m=nope, n=none}}{{?if m == nil and n == nil}}nil{{/if}}{{/with}}`, M{"none": nil}, "nil"},
+	}
+	for _, test := range tests {
+		test.Run(t)
+	}
+
+	c := &counter{}
+	out := Render(`{{#with v=c.Expensive}}{{v}}{{v}}{{?if v > 1}}{{v}}{{/if}}{{/with}}`, M{"c": c})
+	if out != "424242" || c.calls != 1 {
+		t.Errorf("expected 424242 with 1 call, got %q with %d calls", out, c.calls)
+	}
+
+	tmpl, _ := ParseString(`{{#with m=nope}}{{/with}}`)
+	if err := tmpl.ExecuteStrict(ioutil.Discard, M{}); err == nil || !strings.Contains(err.Error(), "nope") {
+		t.Errorf("expected an error naming nope in strict mode, got %v", err)
+	}
+
+	for _, tpl := range []string{`{{#with x}}{{/with}}`, `{{#with x=}}{{/with}}`, `{{#with x=1 y=2}}{{/with}}`, `{{#with x=1,}}{{/with}}`, `{{#with x=y|join}}{{/with}}`} {
+		if _, err := ParseString(tpl); err == nil {
+			t.Errorf("%q: expected a parse error", tpl)
+		}
+	}
+}
+
+func TestCapture(t *testing.T) {
+	page := M{"site": "Tom & Jerry", "page": "Home", "items": []string{"a", "b"}}
+	tests := []Test{
+		{`{{#capture title}}{{page}} | {{site}}{{/capture}}<title>{{title}}</title><h1>{{title}}</h1>`, page,
+			"<title>Home | Tom &amp; Jerry</title><h1>Home | Tom &amp; Jerry</h1>"},
+		{`{{title}}{{#capture title}}x{{/capture}}{{title}}`, M{"title": "y"}, "yx"},
+		// cut markup is no longer safe, so it is escaped
+		{`{{#capture t}}<b>{{page}}</b>{{/capture}}{{t|truncate(6)}}`, page, "&lt;b&gt;..."},
+		// captures stay escaped through filters and concatenation
+		{`{{#capture t}}{{site}}{{/capture}}{{t|upper}}`, page, "TOM &AMP; JERRY"},
+		{`{{#capture t}}{{site}}{{/capture}}{{t|format("[%s]")}}`, page, "[Tom &amp; Jerry]"},
+		{`{{#capture t}}{{site}}{{/capture}}{{t ~ "!"}} {{"<" ~ t}} {{t + t}}`, page, "Tom &amp; Jerry! &lt;Tom &amp; Jerry Tom &amp; JerryTom &amp; Jerry"},
+		{`{{#capture t}}{{site}}{{/capture}}{{t|truncate(9)}} {{t|truncate(11)}}`, page, "Tom &amp; ... Tom &amp; Jerry"},
+		{`{{#capture t}}<b>{{page}}</b>{{/capture}}{{t|truncate(20)}}`, page, "<b>Home</b>"},
+		{`{{#capture t}}{{#items}}{{.}}{{/items}}{{/capture}}{{?if t == "ab"}}yes{{/if}}`, page, "yes"},
+		{`{{#items}}{{#capture t}}[{{.}}]{{/capture}}{{t}}{{t}}{{/items}}{{t}}`, page, "[a][a][b][b]"},
+		{`{{#items}}{{#capture page}}x{{/capture}}{{page}}{{../page}}{{/items}}`, page, "xHomexHome"},
+		{`{{#capture a}}1{{/capture}}{{#capture b}}{{a}}2{{/capture}}{{b}}`, M{}, "12"},
+		{`{{#capture t}}{{page}}{{/capture}}{{#with u=t}}{{u}}{{/with}}`, page, "Home"},
+		{`{{page|truncate(3)}}`, page, "..."},
+		{`{{page|truncate(10)}}`, page, "Home"},
+	}
+	for _, test := range tests {
+		test.Run(t)
+	}
+
+	// captures can be used without any contexts
+	tmpl, err := ParseString(`{{#capture c}}hi{{/capture}}{{#c}}{{.}}x{{/c}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err = tmpl.Execute(&buf); err != nil || buf.String() != "x" {
+		t.Errorf("expected %q, got %q (%v)", "x", buf.String(), err)
+	}
+
+	for _, tpl := range []string{`{{#capture a b}}{{/capture}}`, `{{#capture a}}{{/a}}`} {
+		if _, err := ParseString(tpl); err == nil {
+			t.Errorf("%q: expected a parse error", tpl)
+		}
+	}
+}
+
+func TestArithmetic(t *testing.T) {
+	ctx := M{"page": 2, "total": 5, "price": 9.99, "qty": uint8(3), "name": "bob", "items": []int{1, 2, 3},
+		"big": uint64(1 << 63), "max": int64(1<<63 - 1), "neg": int64(-1)}
+	tests := []Test{
+		{`{{page+1}}`, ctx, "3"},
+		{`{{page + 1 * 2}}`, ctx, "4"},
+		{`{{(page + 1) * 2}}`, ctx, "6"},
+		{`{{total / page}} {{total % page}}`, ctx, "2 1"},
+		{`{{total / 2.0}}`, ctx, "2.5"},
+		{`{{price * qty}}`, ctx, "29.97"},
+		{`{{(price * qty)|format("%.1f")}}`, ctx, "30.0"},
+		{`{{qty - page}}`, ctx, "1"},
+		{`{{-page}}`, ctx, "-2"},
+		{`{{page - -1}}`, ctx, "3"},
+		{`{{page * 100 / total}}%`, ctx, "40%"},
+		{`{{page ~ " of " ~ total}}`, ctx, "2 of 5"},
+		{`{{name + "!"}}`, ctx, "bob!"},
+		{`{{"x"|upper ~ name}}`, ctx, "Xbob"},
+		{`{{items|len - 1}}`, ctx, "2"},
+		{`{{items|index(page - 1)}}`, ctx, "2"},
+		// a name which isn't found is a difference if it ends in -number
+		{`{{page-1}} {{items|index(page-1)}} {{?if page-2 == 0}}zero{{/if}}`, ctx, "1 2 zero"},
+		{`{{max-qty}}{{name-1}}`, ctx, ""},
+		{`{{#with next=page+1}}{{next}}{{/with}}`, ctx, "3"},
+		{`{{#items}}{{.index1 ~ "/" ~ ../total}} {{/items}}`, ctx, "1/5 2/5 3/5 "},
+		{`{{?if page + 1 < total}}more{{/if}}`, ctx, "more"},
+		{`{{?if (page + 3) * 2 == 10}}yes{{/if}}`, ctx, "yes"},
+		{`{{?if page * 2 > total or (total - page) < 1}}yes{{?else}}no{{/if}}`, ctx, "no"},
+		{`{{?if not (page - 2)}}zero{{/if}}`, ctx, "zero"},
+		{`{{?if (page > 1) and (total % 2 == 1)}}odd{{/if}}`, ctx, "odd"},
+		{`{{big + 1}} {{big / qty}}`, ctx, "9223372036854775809 3074457345618258602"},
+		{`{{qty - big}} {{qty - 5}}`, ctx, "-9223372036854775805 -2"},
+		{`{{neg + big}} {{big + neg}} {{big - max}} {{max + 1}}`, ctx, "9223372036854775807 9223372036854775807 1 9223372036854775808"},
+		{`{{neg * big}} {{big / neg}} {{neg % big}} {{-7 % qty}}`, ctx, "-9223372036854775808 -9223372036854775808 -1 -1"},
+		// lenient mode renders nothing for missing names and mismatched types
+		{`{{nope + 1}}`, ctx, ""},
+		{`{{name * 2}}`, ctx, ""},
+		{`{{nope ~ "x"}}`, ctx, ""},
+	}
+	for _, test := range tests {
+		test.Run(t)
+	}
+
+	for _, tpl := range []string{`{{page / 0}}`, `{{price % 0}}`, `{{?if page / (total - 5)}}{{/if}}`} {
+		tmpl, err := ParseString(tpl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = tmpl.Execute(ioutil.Discard, ctx); err == nil || !strings.Contains(err.Error(), "division by zero") {
+			t.Errorf("%q: expected a division by zero error, got %v", tpl, err)
+		}
+	}
+	for _, tpl := range []string{`{{big * 2}}`, `{{big + big}}`, `{{max * max}}`, `{{-max - 2}}`, `{{qty - big - big}}`} {
+		tmpl, err := ParseString(tpl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = tmpl.Execute(ioutil.Discard, ctx); err == nil || !strings.Contains(err.Error(), "overflow") {
+			t.Errorf("%q: expected an overflow error, got %v", tpl, err)
+		}
+	}
+	tmpl, _ := ParseString(`{{name * 2}}`)
+	if err := tmpl.ExecuteStrict(ioutil.Discard, ctx); err == nil {
+		t.Errorf("expected an error in strict mode")
+	}
+	// a - which follows a name is part of it, so a name which isn't found is
+	// a difference, and strict mode hints at spaces if that fails too
+	strict := &Test{`{{page-1}}`, ctx, "1"}
+	strict.RunStrict(t, DefaultEnv)
+	tmpl, _ = ParseString(`{{pages-1}}`)
+	if err := tmpl.ExecuteStrict(ioutil.Discard, ctx); err == nil || !strings.Contains(err.Error(), "pages - 1") {
+		t.Errorf("expected an error suggesting pages - 1, got %v", err)
+	}
+}
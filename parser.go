@@ -3,6 +3,7 @@ package mandira
 import (
 	"fmt"
 	"strconv"
+	"strings"
 )
 
 /* Parser for the extended features in Mandira.
@@ -10,52 +11,112 @@ import (
 word = ([a-zA-Z1-9]+)
 binop = <|<=|>|>=|!=|==
 comb = or|and
-unary = not
 filter = |
 variable = word
 string = " .* "
 atom = variable | string | word
-funcexpr = word [( atom[, atom...] )]
+arithop = +|-|~
+termop = *|/|%
+value = term [arithop term...]
+term = negative [termop negative...]
+negative = [-] primary
+primary = varexpr | atom [|funcexpr...] | ( value ) [|funcexpr...]
+arg = value | word = value
+funcexpr = word [( arg[, arg...] )]
 varexpr = variable [|funcexpr...]
 
-Conditional logic is mostly as expected, with operators of the same precedence
-being computed from left to right.  
+Arithmetic is computed before comparisons, with *, / and % before +, - and
+~, which concatenates strings.  Filters apply to the primary before them,
+so "a * b|len" is "a * (b|len)".  Since names may contain hyphens, a - which
+follows a name is part of it, but a name like "page-1" which is not found is
+"page - 1" if page is a number.
 
-They are, from low to high: binops, combs, unary, parens
+condition = or
+or = and [or and...]
+and = comparison [and comparison...]
+comparison = unary [binop unary...]
+unary = not unary | ( condition ) | value
 
-In the future, "and" may be higher priority than "or".
+Operators are, from low to high precedence: or, and, binops, not.  Operators
+of the same precedence are computed from left to right, so "a < b == c" is
+"(a < b) == c".  "and" and "or" short-circuit, and evaluate to a bool.
+In comparisons, true, false and nil which aren't names in the context are
+literals.
 
 */
 
+// An arithExpr is a binary arithmetic operation or concatenation of two values,
+// which are literals, varExprs or arithExprs
+type arithExpr struct {
+	op  string
+	lhs interface{}
+	rhs interface{}
+}
+
+// The precedence of arithmetic operators
+var arithPrecedence = map[string]int{"+": 1, "-": 1, "~": 1, "*": 2, "/": 2, "%": 2}
+
 // A lookup expression is a naked word which will be looked up in the context at render time
 type lookupExpr struct {
 	name string
 }
 
-// A varExpr is a lookupExpr followed by zero or more funcExprs
+// A varExpr is a lookupExpr followed by zero or more funcExprs.  The first
+// expression can also be a literal or an arithExpr, if it has filters.
 type varExpr struct {
 	exprs []interface{}
 }
 
-// A func expression has a function name to be looked up in the filter list 
-// at render time and a list of arguments, which are varExprs or literals
+// A func expression has a function name to be looked up in the filter list
+// at render time and a list of arguments, which are varExprs or literals.
+// Arguments are full varExprs, so they can have filters of their own.
+// Keyword arguments follow the positional arguments.
 type funcExpr struct {
 	name      string
 	arguments []interface{}
+	keywords  []*keywordArg
+}
+
+// A keyword argument to a filter, like currency="EUR"
+type keywordArg struct {
+	name  string
+	value interface{}
 }
 
-// A cond is a unary condition with a single value and optional negation
-type cond struct {
-	not  bool
+// A condition is a node of a parsed condition, which evaluates to a value.
+type condition interface {
+	Eval(s *state, contexts []interface{}) (interface{}, error)
+}
+
+// A valueExpr is a condition with a single value, which is a literal, varExpr
+// or arithExpr
+type valueExpr struct {
 	expr interface{}
 }
 
-// A conditional is a n-ary conditional with n opers and n+1 expressions, which
-// can be conds or conditionals
-type conditional struct {
-	not   bool
-	opers []string
-	exprs []interface{}
+// A notExpr negates a condition
+type notExpr struct {
+	expr condition
+}
+
+// A compExpr compares two conditions with a binop
+type compExpr struct {
+	op  string
+	lhs condition
+	rhs condition
+}
+
+// A boolExpr combines two conditions with "and" or "or"
+type boolExpr struct {
+	op  string
+	lhs condition
+	rhs condition
+}
+
+// The precedence of condition operators
+var condPrecedence = map[string]int{
+	"or": 1, "and": 2,
+	"<": 3, "<=": 3, ">": 3, ">=": 3, "==": 3, "!=": 3,
 }
 
 // A list of tokens with a pointer (p) and a run (run)
@@ -123,85 +184,173 @@ func parseAtom(token string) interface{} {
 	return &lookupExpr{token}
 }
 
-// parse a value, which is a literal or a variable expression
+// parse a value, which is a literal, a variable expression, or arithmetic on
+// them
 func parseValue(tokens *tokenList) (interface{}, error) {
+	return parseArithmetic(tokens, 1)
+}
+
+// Parse arithmetic with operators of at least precedence prec, by precedence
+// climbing.  Operators of the same precedence are computed from left to right.
+func parseArithmetic(tokens *tokenList, prec int) (interface{}, error) {
+	lhs, err := parseUnary(tokens)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := tokens.Peek()
+		p, ok := arithPrecedence[op]
+		if !ok || p < prec {
+			return lhs, nil
+		}
+		tokens.Next()
+		rhs, err := parseArithmetic(tokens, p+1)
+		if err != nil {
+			return nil, err
+		}
+		lhs = &arithExpr{op, lhs, rhs}
+	}
+}
+
+// parse a primary which may be negated
+func parseUnary(tokens *tokenList) (interface{}, error) {
+	if tokens.Peek() != "-" {
+		return parsePrimary(tokens)
+	}
+	tokens.Next()
+	val, err := parseUnary(tokens)
+	if err != nil {
+		return nil, err
+	}
+	switch v := val.(type) {
+	case int64:
+		return -v, nil
+	case float64:
+		return -v, nil
+	}
+	return &arithExpr{"-", int64(0), val}, nil
+}
+
+// parse a literal, variable expression, or a parenthesized value, which can
+// be followed by filters
+func parsePrimary(tokens *tokenList) (interface{}, error) {
 	tok := tokens.Next()
 	if len(tok) == 0 {
 		return nil, &parserError{tokens, "Expected a value, found nothing"}
 	}
-	try := parseAtom(tok)
-	/* if this wasn't a lookupExpr, then it's a literal */
-	if _, ok := try.(*lookupExpr); !ok {
-		return try, nil
+	var head interface{}
+	switch tok {
+	case "(":
+		val, err := parseValue(tokens)
+		if err != nil {
+			return nil, err
+		}
+		if tokens.Peek() != ")" {
+			return nil, &parserError{tokens, "Expected closing paren"}
+		}
+		tokens.Next()
+		head = val
+	case ")", ",", "|", "=", "<", ">", "<=", ">=", "==", "!=", "+", "-", "~", "*", "/", "%":
+		tokens.Prev()
+		return nil, &parserError{tokens, "Expected a value"}
+	default:
+		head = parseAtom(tok)
+		/* a lookupExpr starts a variable expression */
+		if _, ok := head.(*lookupExpr); ok {
+			tokens.Prev()
+			return parseVarExpression(tokens)
+		}
+	}
+	if tokens.Peek() != "|" {
+		return head, nil
 	}
-	tokens.Prev()
-	varexp, err := parseVarExpression(tokens)
-	return varexp, err
+	expr := &varExpr{exprs: []interface{}{head}}
+	for tokens.Peek() == "|" {
+		tokens.Next()
+		fe, err := parseFuncExpression(tokens)
+		if err != nil {
+			return expr, err
+		}
+		expr.exprs = append(expr.exprs, fe)
+	}
+	return expr, nil
 }
 
-// parse a value and return a unary cond expr (to negate values)
-func parseCond(tokens *tokenList) (*cond, error) {
-	var err error
-	c := &cond{}
-	c.expr, err = parseValue(tokens)
-	return c, err
+// Parse a condition, which must use all of the tokens.
+func parseCondition(tokens *tokenList) (condition, error) {
+	expr, err := parseBinaryCondition(tokens, 1)
+	if err != nil {
+		return nil, err
+	}
+	if tokens.Remaining() > 0 {
+		return nil, &parserError{tokens, "Unexpected token"}
+	}
+	return expr, nil
 }
 
-// Parse a conditional expression, recurse each time a paren is encountered
-func parseCondition(tokens *tokenList) (*conditional, error) {
-	c := &conditional{}
-	negated := false
-	expectCond := true
-
-	for tok := tokens.Next(); len(tok) > 0; tok = tokens.Next() {
-		switch tok {
-		case "(":
-			if !expectCond {
-				return c, &parserError{tokens, "Expected an operator, not a " + tok}
-			}
-			expr, err := parseCondition(tokens)
-			if err != nil {
-				return c, err
-			}
-			expr.not = negated
-			c.exprs = append(c.exprs, expr)
-
-			negated = false
-			expectCond = false
-		case "not":
-			if !expectCond {
-				return c, &parserError{tokens, "Expected an operator, not a " + tok}
-			}
-			negated = !negated
-		case ")":
-			if expectCond {
-				return c, &parserError{tokens, "Expected a condition, not a " + tok}
-			}
-			return c, nil
-		case "or", "and", ">", "<", "<=", ">=", "==", "!=":
-			if expectCond {
-				return c, &parserError{tokens, "Expected a condition, not an operator " + tok}
-			}
-			c.opers = append(c.opers, tok)
-			expectCond = true
-		default:
-			if !expectCond {
-				return c, &parserError{tokens, "Expected an operator, not " + tok}
-			}
-			tokens.Prev()
-			expr, err := parseCond(tokens)
-			if err != nil {
-				return c, err
-			}
-			expr.not = negated
-			c.exprs = append(c.exprs, expr)
-			// reset everything
-			expectCond = false
-			negated = false
+// Parse a condition with operators of at least precedence prec, by
+// precedence climbing.
+func parseBinaryCondition(tokens *tokenList, prec int) (condition, error) {
+	lhs, err := parseUnaryCondition(tokens)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := tokens.Peek()
+		p, ok := condPrecedence[op]
+		if !ok || p < prec {
+			return lhs, nil
+		}
+		tokens.Next()
+		rhs, err := parseBinaryCondition(tokens, p+1)
+		if err != nil {
+			return nil, err
+		}
+		if op == "and" || op == "or" {
+			lhs = &boolExpr{op, lhs, rhs}
+		} else {
+			lhs = &compExpr{op, lhs, rhs}
 		}
 	}
+}
 
-	return c, nil
+// Parse a negated condition, a condition in parens, or a value.
+func parseUnaryCondition(tokens *tokenList) (condition, error) {
+	switch tokens.Peek() {
+	case "not":
+		tokens.Next()
+		expr, err := parseUnaryCondition(tokens)
+		if err != nil {
+			return nil, err
+		}
+		return &notExpr{expr}, nil
+	case "(":
+		// a parenthesized value, like (a + b), is an operand;  anything
+		// else in parens is a nested condition
+		start := tokens.p
+		if val, err := parseValue(tokens); err == nil {
+			return &valueExpr{val}, nil
+		}
+		tokens.p = start + 1
+		expr, err := parseBinaryCondition(tokens, 1)
+		if err != nil {
+			return nil, err
+		}
+		if tokens.Peek() != ")" {
+			return nil, &parserError{tokens, "Expected closing paren"}
+		}
+		tokens.Next()
+		return expr, nil
+	}
+	switch tok := tokens.Peek(); tok {
+	case "and", "or", "<", "<=", ">", ">=", "==", "!=", ")":
+		return nil, &parserError{tokens, "Expected a condition, not " + tok}
+	}
+	val, err := parseValue(tokens)
+	if err != nil {
+		return nil, err
+	}
+	return &valueExpr{val}, nil
 }
 
 // parse a function expression, which comes after each | in a filter
@@ -211,22 +360,51 @@ func parseFuncExpression(tokens *tokenList) (*funcExpr, error) {
 	if len(fe.name) == 0 {
 		return fe, &parserError{tokens, "Expected filter name, got nil"}
 	}
-	tok := tokens.Peek()
-	if tok == "(" {
+	if tokens.Peek() != "(" {
+		return fe, nil
+	}
+	tokens.Next()
+	if tokens.Peek() == ")" {
 		tokens.Next()
-		for tok = tokens.Next(); len(tok) > 0; tok = tokens.Next() {
-			fe.arguments = append(fe.arguments, parseAtom(tok))
-			tok = tokens.Next()
-			if tok == ")" {
-				break
+		return fe, nil
+	}
+	for {
+		var name string
+		tok := tokens.Next()
+		if len(tok) > 0 && tokens.Peek() == "=" {
+			if _, ok := parseAtom(tok).(*lookupExpr); !ok {
+				return fe, &parserError{tokens, "Expected a keyword, not " + tok}
 			}
-			if tok != "," {
-				return fe, &parserError{tokens, "Expected comma (,)"}
+			name = tok
+			tokens.Next()
+		} else {
+			tokens.Prev()
+		}
+		arg, err := parseValue(tokens)
+		if err != nil {
+			return fe, err
+		}
+		if len(name) > 0 {
+			for _, kw := range fe.keywords {
+				if kw.name == name {
+					return fe, &parserError{tokens, "Repeated keyword argument " + name}
+				}
 			}
+			fe.keywords = append(fe.keywords, &keywordArg{name, arg})
+		} else if len(fe.keywords) > 0 {
+			return fe, &parserError{tokens, "Positional argument after keyword argument"}
+		} else {
+			fe.arguments = append(fe.arguments, arg)
+		}
+		switch tokens.Next() {
+		case ")":
+			return fe, nil
+		case ",":
+		default:
+			tokens.Prev()
+			return fe, &parserError{tokens, "Expected comma (,) or closing paren"}
 		}
 	}
-
-	return fe, nil
 }
 
 // parse a variable expression, which is a lookup + 0 or more func exprs
@@ -268,14 +446,22 @@ func parseVarExpression(tokens *tokenList) (*varExpr, error) {
 // Parse aa "variable element", which returns a varElement (AST)
 func parseVarElement(s string) (*varElement, error) {
 	var elem = &varElement{}
-	tokens, err := tokenize(s)
+	toks, err := tokenize(s)
 	if err != nil {
 		return elem, err
 	}
-	expr, err := parseVarExpression(&tokenList{tokens, 0, 0})
+	tokens := &tokenList{toks, 0, 0}
+	val, err := parseValue(tokens)
 	if err != nil {
 		return elem, err
 	}
+	if tokens.Remaining() > 0 {
+		return elem, &parserError{tokens, "Unexpected token"}
+	}
+	expr, ok := val.(*varExpr)
+	if !ok {
+		expr = &varExpr{exprs: []interface{}{val}}
+	}
 	elem.expr = expr
 	return elem, nil
 }
@@ -295,6 +481,99 @@ func parseCondElement(s string) (*sectionElement, error) {
 	return elem, nil
 }
 
+// Parse a list of bindings like "total=items|len, first=items|index(0)", as in
+// a with section.
+func parseBindings(s string) ([]*keywordArg, error) {
+	toks, err := tokenize(s)
+	if err != nil {
+		return nil, err
+	}
+	tokens := &tokenList{toks, 0, 0}
+	var bindings []*keywordArg
+	for {
+		name := tokens.Next()
+		if len(name) == 0 {
+			return bindings, &parserError{tokens, "Expected a binding"}
+		}
+		if _, ok := parseAtom(name).(*lookupExpr); !ok {
+			return bindings, &parserError{tokens, "Expected a name, not " + name}
+		}
+		if tokens.Next() != "=" {
+			tokens.Prev()
+			return bindings, &parserError{tokens, "Expected = after " + name}
+		}
+		value, err := parseValue(tokens)
+		if err != nil {
+			return bindings, err
+		}
+		bindings = append(bindings, &keywordArg{name, value})
+		switch tokens.Next() {
+		case "":
+			return bindings, nil
+		case ",":
+		default:
+			tokens.Prev()
+			return bindings, &parserError{tokens, "Expected comma (,)"}
+		}
+	}
+}
+
+// Call fn for each funcExpr in expr, which may be a varExpr, arithExpr or
+// condition, stopping at the first error.
+func walkFuncExprs(expr interface{}, fn func(*funcExpr) error) error {
+	switch e := expr.(type) {
+	case *arithExpr:
+		if err := walkFuncExprs(e.lhs, fn); err != nil {
+			return err
+		}
+		return walkFuncExprs(e.rhs, fn)
+	case *varExpr:
+		for _, exp := range e.exprs {
+			f, ok := exp.(*funcExpr)
+			if !ok {
+				if err := walkFuncExprs(exp, fn); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := fn(f); err != nil {
+				return err
+			}
+			for _, arg := range f.arguments {
+				if err := walkFuncExprs(arg, fn); err != nil {
+					return err
+				}
+			}
+			for _, kw := range f.keywords {
+				if err := walkFuncExprs(kw.value, fn); err != nil {
+					return err
+				}
+			}
+		}
+	case *valueExpr:
+		return walkFuncExprs(e.expr, fn)
+	case *notExpr:
+		return walkFuncExprs(e.expr, fn)
+	case *compExpr:
+		if err := walkFuncExprs(e.lhs, fn); err != nil {
+			return err
+		}
+		return walkFuncExprs(e.rhs, fn)
+	case *boolExpr:
+		if err := walkFuncExprs(e.lhs, fn); err != nil {
+			return err
+		}
+		return walkFuncExprs(e.rhs, fn)
+	}
+	return nil
+}
+
+// Return whether s is a number.
+func isNumeric(s string) bool {
+	_, err := strconv.ParseFloat(s, 64)
+	return err == nil
+}
+
 // tokenize an expression, returning a list of strings or an error
 func tokenize(c string) ([]string, error) {
 	b := []byte(c)
@@ -307,8 +586,9 @@ func tokenize(c string) ([]string, error) {
 				tn.tokens = append(tn.tokens, string(b[tn.run:tn.p]))
 			}
 			tn.run = tn.p + 1
-		/* tokens which can be singular or double */
-		case '<', '>':
+		/* tokens which can be singular or double;  a single = is only valid
+		   in keyword arguments */
+		case '<', '>', '=':
 			if tn.run < tn.p {
 				tn.tokens = append(tn.tokens, string(b[tn.run:tn.p]))
 			}
@@ -320,7 +600,7 @@ func tokenize(c string) ([]string, error) {
 			}
 			tn.run = tn.p + 1
 		/* tokens which must be double */
-		case '!', '=':
+		case '!':
 			if tn.run < tn.p {
 				tn.tokens = append(tn.tokens, string(b[tn.run:tn.p]))
 			}
@@ -341,12 +621,22 @@ func tokenize(c string) ([]string, error) {
 				}
 			}
 			tn.run = tn.p + 1
-		/* tokens which are only ever single */
-		case '|', '(', ')', ',':
-			if tn.p > 0 && b[tn.p] == '\\' && b[tn.p] == '"' {
-				tn.run = tn.p + 1
+		/* a - is part of a name, a / is part of a ../ path */
+		case '-', '/':
+			run := string(b[tn.run:tn.p])
+			if b[tn.p] == '-' && len(run) > 0 && !isNumeric(run) {
+				continue
+			}
+			if b[tn.p] == '/' && len(run) > 0 && strings.Trim(run, "./") == "" {
 				continue
 			}
+			if tn.run < tn.p {
+				tn.tokens = append(tn.tokens, run)
+			}
+			tn.tokens = append(tn.tokens, string(b[tn.p]))
+			tn.run = tn.p + 1
+		/* tokens which are only ever single */
+		case '|', '(', ')', ',', '+', '*', '%', '~':
 			if tn.run < tn.p {
 				tn.tokens = append(tn.tokens, string(b[tn.run:tn.p]))
 			}
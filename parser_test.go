@@ -1,6 +1,7 @@
 package mandira
 
 import (
+	"fmt"
 	"testing"
 )
 
@@ -24,10 +25,19 @@ func TestTokenizer(t *testing.T) {
 		MS{"i>a": []string{"i", ">", "a"}},
 		MS{`bare|func("foo", bar, 1.5) >= 9`: []string{"bare", "|", "func", "(", `"foo"`, ",", "bar", ",", "1.5", ")", ">=", "9"}},
 		MS{`b|func("foo bar, 今日は世界")`: []string{"b", "|", "func", "(", `"foo bar, 今日は世界"`, ")"}},
+		MS{`a|money(places=2)`: []string{"a", "|", "money", "(", "places", "=", "2", ")"}},
+		MS{"a = b": []string{"a", "=", "b"}},
+		MS{"page+1": []string{"page", "+", "1"}},
+		MS{"a*b%c~d": []string{"a", "*", "b", "%", "c", "~", "d"}},
+		MS{"a - b": []string{"a", "-", "b"}},
+		MS{"a-b": []string{"a-b"}},
+		MS{"1-2": []string{"1", "-", "2"}},
+		MS{"-a": []string{"-", "a"}},
+		MS{"a/b": []string{"a", "/", "b"}},
+		MS{"../../a/b": []string{"../../a", "/", "b"}},
 	}
 	errs := []string{
-		"a = b", // single = is an invalid token
-		"!a",    // single ! is an invalid token
+		"!a", // single ! is an invalid token
 	}
 
 	for _, test := range tests {
@@ -158,9 +168,13 @@ func TestVarParser(t *testing.T) {
 	if f != 3.5 {
 		t.Errorf("Expecting 3.5, got %v\n", f)
 	}
-	lu, ok = fu.arguments[2].(*lookupExpr)
+	ve, ok := fu.arguments[2].(*varExpr)
 	if !ok {
-		t.Errorf("Expecting lookupExpr as third arg\n")
+		t.Fatalf("Expecting varExpr as third arg\n")
+	}
+	lu, ok = ve.exprs[0].(*lookupExpr)
+	if !ok {
+		t.Errorf("Expecting lookupExpr in third arg\n")
 	}
 	if lu.name != "someVar" {
 		t.Errorf("Expecting name \"someVar\", got %s\n", lu.name)
@@ -183,3 +197,163 @@ func TestVarParser(t *testing.T) {
 		t.Errorf(`Expecting "hi", got %s`+"\n", s)
 	}
 }
+
+func TestFilterArguments(t *testing.T) {
+	expr, err := parseVarExpression(ntl(`items|join(sep|default(", "), n)|upper()`))
+	tErr(t, err)
+	if len(expr.exprs) != 3 {
+		t.Fatalf("Expected 3 expressions, got %d (%v)\n", len(expr.exprs), expr.exprs)
+	}
+	fu := expr.exprs[1].(*funcExpr)
+	if len(fu.arguments) != 2 {
+		t.Fatalf("Expected 2 arguments, got %v\n", fu.arguments)
+	}
+	arg, ok := fu.arguments[0].(*varExpr)
+	if !ok || len(arg.exprs) != 2 {
+		t.Fatalf("Expected a varExpr with a filter as first arg, got %v\n", fu.arguments[0])
+	}
+	def := arg.exprs[1].(*funcExpr)
+	if def.name != "default" || len(def.arguments) != 1 || def.arguments[0] != ", " {
+		t.Errorf("Expected default(\", \"), got %v\n", def)
+	}
+	if fu := expr.exprs[2].(*funcExpr); len(fu.arguments) != 0 {
+		t.Errorf("Got unexpected arguments (%v)\n", fu.arguments)
+	}
+
+	for _, e := range []string{`a|join(`, `a|join(b c)`, `a|join(b,)`, `a|join(b|)`} {
+		if _, err := parseVarExpression(ntl(e)); err == nil {
+			t.Errorf("Expected parse error on \"%v\"\n", e)
+		}
+	}
+}
+
+func TestKeywordArguments(t *testing.T) {
+	expr, err := parseVarExpression(ntl(`price|money(sym, currency="EUR", places=n|len)`))
+	tErr(t, err)
+	fu := expr.exprs[1].(*funcExpr)
+	if len(fu.arguments) != 1 || len(fu.keywords) != 2 {
+		t.Fatalf("Expected 1 argument and 2 keywords, got %v and %v\n", fu.arguments, fu.keywords)
+	}
+	if fu.keywords[0].name != "currency" || fu.keywords[0].value != "EUR" {
+		t.Errorf("Expected currency=\"EUR\", got %v\n", fu.keywords[0])
+	}
+	if ve, ok := fu.keywords[1].value.(*varExpr); fu.keywords[1].name != "places" || !ok || len(ve.exprs) != 2 {
+		t.Errorf("Expected places=n|len, got %v\n", fu.keywords[1])
+	}
+
+	errs := []string{
+		`a|f(x=1, 2)`,   // positional after keyword
+		`a|f(x=1, x=2)`, // repeated keyword
+		`a|f("x"=1)`,    // keyword must be a word
+		`a|f(x=)`,       // missing value
+	}
+	for _, e := range errs {
+		if _, err := parseVarExpression(ntl(e)); err == nil {
+			t.Errorf("Expected parse error on \"%v\"\n", e)
+		}
+	}
+	// a single = is not a comparison
+	if _, err := parseCondition(ntl("a = b")); err == nil {
+		t.Errorf("Expected parse error on \"a = b\"\n")
+	}
+}
+
+// Return a string showing the structure of an arithmetic expression
+func showArith(expr interface{}) string {
+	switch e := expr.(type) {
+	case *arithExpr:
+		return "(" + showArith(e.lhs) + " " + e.op + " " + showArith(e.rhs) + ")"
+	case *varExpr:
+		s := showArith(e.exprs[0])
+		for _, f := range e.exprs[1:] {
+			s += "|" + f.(*funcExpr).name
+		}
+		return s
+	case *lookupExpr:
+		return e.name
+	}
+	return fmt.Sprint(expr)
+}
+
+func TestArithmeticParser(t *testing.T) {
+	tests := map[string]string{
+		"a + b * c":         "(a + (b * c))",
+		"a * b + c":         "((a * b) + c)",
+		"a - b - c":         "((a - b) - c)",
+		"a / b % c":         "((a / b) % c)",
+		"(a + b) * c":       "((a + b) * c)",
+		`a ~ " of " ~ b`:    "((a ~  of ) ~ b)",
+		"a * b|len":         "(a * b|len)",
+		"(a * b)|len + 1":   "((a * b)|len + 1)",
+		"-a + -1":           "((0 - a) + -1)",
+		"--2":               "2",
+		`"x"|upper ~ y`:     "(x|upper ~ y)",
+		"a|f(b + 1, c) * 2": "(a|f * 2)",
+	}
+	for e, expected := range tests {
+		expr, err := parseValue(ntl(e))
+		tErr(t, err)
+		if got := showArith(expr); got != expected {
+			t.Errorf("%q: expected %s, got %s\n", e, expected, got)
+		}
+	}
+
+	for _, e := range []string{"a +", "* a", "(a + b", "a + )", "a * * b"} {
+		if _, err := parseValue(ntl(e)); err == nil {
+			t.Errorf("Expected parse error on \"%v\"\n", e)
+		}
+	}
+	if _, err := parseVarElement("a b"); err == nil {
+		t.Errorf("Expected parse error on \"a b\"\n")
+	}
+}
+
+func showCond(c condition) string {
+	switch e := c.(type) {
+	case *valueExpr:
+		return showArith(e.expr)
+	case *notExpr:
+		return "not " + showCond(e.expr)
+	case *compExpr:
+		return "(" + showCond(e.lhs) + " " + e.op + " " + showCond(e.rhs) + ")"
+	case *boolExpr:
+		return "(" + showCond(e.lhs) + " " + e.op + " " + showCond(e.rhs) + ")"
+	}
+	return fmt.Sprint(c)
+}
+
+func TestConditionParser(t *testing.T) {
+	tests := map[string]string{
+		"a or b and c":              "(a or (b and c))",
+		"a and b or c":              "((a and b) or c)",
+		"a or b or c":               "((a or b) or c)",
+		"a == 1 or b < 2 and c":     "((a == 1) or ((b < 2) and c))",
+		"not a == b":                "(not a == b)",
+		"not a and b":               "(not a and b)",
+		"not (a and b)":             "not (a and b)",
+		"not not a":                 "not not a",
+		"(a or b) and c":            "((a or b) and c)",
+		"a < b == c":                "((a < b) == c)",
+		"a + 1 > b * 2":             "((a + 1) > (b * 2))",
+		"(a + 1) * 2 > b":           "(((a + 1) * 2) > b)",
+		"((a))":                     "a",
+		"(a == b) and (c or d)":     "((a == b) and (c or d))",
+		"a|len > 2 and not b|len":   "((a|len > 2) and not b|len)",
+		"x or (y and (z or not w))": "(x or (y and (z or not w)))",
+		"a == true or b != nil":     "((a == true) or (b != nil))",
+		"false|default(1) < a":      "(false|default < a)",
+	}
+	for e, expected := range tests {
+		expr, err := parseCondition(ntl(e))
+		tErr(t, err)
+		if got := showCond(expr); got != expected {
+			t.Errorf("%q: expected %s, got %s\n", e, expected, got)
+		}
+	}
+
+	for _, e := range []string{"", "a or", "and a", "a == == b", "(a or b", "a or b)", "not", "a b", "a < or b"} {
+		if _, err := parseCondition(ntl(e)); err == nil {
+			t.Errorf("Expected parse error on \"%v\"\n", e)
+		}
+	}
+}
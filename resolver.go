@@ -0,0 +1,61 @@
+package mandira
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// A Resolver finds the template named by a partial tag.  Templates parsed
+// with ParseString and ParseFile look for partials on the filesystem, while
+// templates parsed by a Loader resolve them through that Loader.
+type Resolver interface {
+	Resolve(name string) (*Template, error)
+}
+
+// fileResolver looks for partials relative to dir, and then relative to
+// the working directory, and parses them in env.  parents are the absolute
+// paths of the files currently being parsed, and are used to detect cyclic
+// includes.
+type fileResolver struct {
+	dir     string
+	parents []string
+	env     *Env
+}
+
+func (r *fileResolver) Resolve(name string) (*Template, error) {
+	filenames := []string{
+		path.Join(r.dir, name),
+		path.Join(r.dir, name+".mustache"),
+		path.Join(r.dir, name+".stache"),
+		name,
+		name + ".mustache",
+		name + ".stache",
+	}
+	var filename string
+	for _, name := range filenames {
+		f, err := os.Open(name)
+		if err == nil {
+			filename = name
+			f.Close()
+			break
+		}
+	}
+	if filename == "" {
+		return nil, errors.New(fmt.Sprintf("Could not find partial %q", name))
+	}
+
+	abs, err := filepath.Abs(filename)
+	if err != nil {
+		return nil, err
+	}
+	for _, parent := range r.parents {
+		if parent == abs {
+			return nil, fmt.Errorf("cyclic partial %q", name)
+		}
+	}
+
+	return parseFile(filename, r.env, append(r.parents[:len(r.parents):len(r.parents)], abs))
+}